@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ----- Model output schema and validation -----
+//
+// The request carries a response_schema built from the prompt template, so
+// Gemini's structured output mode returns the fields we ask for. The reply
+// is still checked before it becomes an Analysis:
+//   - every core field must be present,
+//   - is_away and is_focused can't both be true,
+//   - text_summary must be non-empty,
+// otherwise the reply is rejected and requested again (analysis.retries,
+// default 2); if no attempt passes the sample fails instead of being stored.
+// Smaller problems are fixed and noted in Analysis.Flags: focus_level is
+// clamped to 0..1 and long summaries are cut to maxSummaryLen.
+
+const (
+	defaultAnalysisRetries = 2
+	maxSummaryLen          = 200 // runes
+
+	flagFocusClamped     = "focus_level_clamped"
+	flagSummaryTruncated = "summary_truncated"
+	flagExtraMissing     = "extra_missing" // suffixed with ":<field>"
+)
+
+// invalidAnalysisError is a model reply that failed validation.
+type invalidAnalysisError struct {
+	Problems []string
+	Raw      string
+}
+
+func (e *invalidAnalysisError) Error() string {
+	return fmt.Sprintf("invalid model reply (%s): %s", strings.Join(e.Problems, "; "), e.Raw)
+}
+
+// responseSchema is the template's fields as a Gemini OpenAPI-subset schema.
+func responseSchema(p PromptTemplate) map[string]any {
+	props := map[string]any{}
+	order := make([]string, 0, len(p.Fields))
+	for _, f := range p.Fields {
+		prop := map[string]any{"type": strings.ToUpper(f.Type), "description": f.Description}
+		if f.Name == "focus_level" {
+			prop["minimum"] = 0
+			prop["maximum"] = 1
+		}
+		props[f.Name] = prop
+		order = append(order, f.Name)
+	}
+	return map[string]any{
+		"type":             "OBJECT",
+		"properties":       props,
+		"required":         corePromptFields,
+		"propertyOrdering": order,
+	}
+}
+
+// parseAnalysis decodes and validates a model reply.
+func parseAnalysis(tmpl PromptTemplate, text string) (Analysis, error) {
+	body := []byte(text)
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		// Try to trim code fences if present
+		cleaned := strings.TrimSpace(text)
+		cleaned = strings.TrimPrefix(cleaned, "```json")
+		cleaned = strings.TrimPrefix(cleaned, "```")
+		cleaned = strings.TrimSuffix(cleaned, "```")
+		body = []byte(strings.TrimSpace(cleaned))
+		if err2 := json.Unmarshal(body, &raw); err2 != nil {
+			return Analysis{}, &invalidAnalysisError{Problems: []string{"not a JSON object: " + err2.Error()}, Raw: text}
+		}
+	}
+
+	var problems []string
+	for _, name := range corePromptFields {
+		if _, ok := raw[name]; !ok {
+			problems = append(problems, "missing "+name)
+		}
+	}
+	// Only the core fields come from the model; the rest of Analysis
+	// (flags, prompt ID, dedup provenance, ...) is ours to set
+	var core struct {
+		IsFocused   bool    `json:"is_focused"`
+		FocusLevel  float64 `json:"focus_level"`
+		IsAway      bool    `json:"is_away"`
+		TextSummary string  `json:"text_summary"`
+	}
+	if err := json.Unmarshal(body, &core); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return Analysis{}, &invalidAnalysisError{Problems: problems, Raw: text}
+	}
+	a := Analysis{IsFocused: core.IsFocused, FocusLevel: core.FocusLevel, IsAway: core.IsAway, TextSummary: core.TextSummary}
+
+	if a.IsAway && a.IsFocused {
+		problems = append(problems, "is_away and is_focused both true")
+	}
+	a.TextSummary = strings.TrimSpace(a.TextSummary)
+	if a.TextSummary == "" {
+		problems = append(problems, "empty text_summary")
+	}
+	if len(problems) > 0 {
+		return Analysis{}, &invalidAnalysisError{Problems: problems, Raw: text}
+	}
+
+	if a.FocusLevel < 0 || a.FocusLevel > 1 {
+		a.FocusLevel = min(max(a.FocusLevel, 0), 1)
+		a.Flags = append(a.Flags, flagFocusClamped)
+	}
+	if utf8.RuneCountInString(a.TextSummary) > maxSummaryLen {
+		a.TextSummary = string([]rune(a.TextSummary)[:maxSummaryLen-1]) + "…"
+		a.Flags = append(a.Flags, flagSummaryTruncated)
+	}
+	a.PromptID = tmpl.ID
+	a.Extra = parseExtraFields(tmpl, raw)
+	for _, f := range tmpl.extraFields() {
+		if _, ok := a.Extra[f.Name]; !ok {
+			a.Flags = append(a.Flags, flagExtraMissing+":"+f.Name)
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ----- Application -----
+//
+// An App is one base station: the session state, where it is stored and the
+// capture and analysis backends. main builds one for the repo root and hands
+// it to RegisterRoutes; tests can run several side by side, each with its own
+// root and fakes for Capturer and Analyzer.
+
+// Capturer takes the photo and the audio reading for one sample.
+type Capturer interface {
+	// CaptureImage saves a frame taken at about at and returns its path.
+	CaptureImage(ctx context.Context, at time.Time) (string, error)
+	// CaptureAudio records the audio window starting at at.
+	CaptureAudio(ctx context.Context, at time.Time) (AudioSummary, error)
+}
+
+// Analyzer sends a GenerateContent request body to the model and returns the
+// reply text and the call's token usage.
+type Analyzer interface {
+	GenerateContent(ctx context.Context, body []byte) (string, usageMetadata, error)
+}
+
+type App struct {
+	store store
+
+	// cfg and the backends built from it, guarded by cfgMu since a reload
+	// swaps them (reload.go). cfgMu is taken last; read through config,
+	// capturer, analyzer and monitor.
+	cfgMu    sync.RWMutex
+	cfg      Config
+	Capturer Capturer
+	Analyzer Analyzer
+	audioMon *audioMonitor // nil unless audio.monitor is enabled
+	reloadMu sync.Mutex    // serializes reloads
+
+	// procCtx parents every python child and capture; cancelling it kills them all.
+	procCtx     context.Context
+	cancelProcs context.CancelFunc
+
+	captures captureCoordinator
+	jobs     jobStore
+	dedup    dedupCache
+	triggers triggerState
+
+	promptMu      sync.Mutex
+	currentPrompt PromptTemplate
+
+	// Scheduler, guarded by schedMu. Lock order: schedMu, then mu.
+	schedMu         sync.Mutex
+	tickerStopChan  chan struct{}
+	schedulerDone   chan struct{}
+	schedulerCancel context.CancelFunc
+	schedulerWake   chan struct{} // re-reads the interval (wakeScheduler)
+	schedulerKick   chan struct{} // runs a cycle now (kickScheduler)
+
+	// saveMu serializes state snapshots (saveState).
+	saveMu sync.Mutex
+
+	// Session state, guarded by mu. Readers take RLock; nothing that holds
+	// mu may call a method that takes it again, and nothing does I/O
+	// under it. Functions named *Locked expect the caller to hold it.
+	mu                sync.RWMutex
+	sessionActive     bool
+	sessionStart      time.Time
+	lastImageFile     string
+	lastAnalysis      Analysis
+	samplesCount      int
+	focusHistory      []FocusPoint
+	shuttingDown      bool
+	currentSessionID  string
+	lastRecordedSeq   uint64
+	downtime          []Interval
+	sessions          []Session
+	noiseEvents       []NoiseEvent             // from the audio monitor (audiomonitor.go)
+	distractionEvents []DistractionEvent       // out-of-band samples (triggers.go)
+	sessionUsage      AnalysisUsage            // model usage (usage.go)
+	dailyUsage        map[string]AnalysisUsage // by YYYY-MM-DD
+	recentFrames      []contextFrame           // context for the next analyses (framecontext.go)
+
+	// Presence-driven pause/standby (presence.go)
+	sessionPaused      bool
+	pausedSince        time.Time
+	pauses             []Interval
+	transitions        []Transition
+	awayStreak         int
+	awaySince          time.Time
+	standbyArmed       bool
+	standbyClearedDesk bool
+}
+
+// NewApp returns a station for cfg that captures with the wili python scripts
+// and analyzes with Gemini. Nothing is loaded or started yet.
+func NewApp(cfg Config) *App {
+	ctx, cancel := context.WithCancel(context.Background())
+	app := &App{cfg: cfg, procCtx: ctx, cancelProcs: cancel}
+	app.store = store{dir: app.sessionsDir()}
+	app.Capturer = newPythonCapturer(cfg)
+	app.Analyzer = newGeminiAnalyzer(cfg)
+	app.jobs = jobStore{app: app, jobs: map[string]*captureJob{}}
+	return app
+}
+
+func (app *App) config() Config {
+	app.cfgMu.RLock()
+	defer app.cfgMu.RUnlock()
+	return app.cfg
+}
+
+func (app *App) capturer() Capturer {
+	app.cfgMu.RLock()
+	defer app.cfgMu.RUnlock()
+	return app.Capturer
+}
+
+func (app *App) analyzer() Analyzer {
+	app.cfgMu.RLock()
+	defer app.cfgMu.RUnlock()
+	return app.Analyzer
+}
+
+func (app *App) monitor() *audioMonitor {
+	app.cfgMu.RLock()
+	defer app.cfgMu.RUnlock()
+	return app.audioMon
+}
+
+// Close stops the scheduler and kills anything still running. Unlike
+// shutdown it neither drains HTTP nor saves state.
+func (app *App) Close() {
+	<-app.stopScheduler()
+	app.cancelProcs()
+}
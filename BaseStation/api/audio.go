@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ----- Audio summaries -----
+//
+// wili/audio.py writes a JSON summary of its capture window (levels,
+// percentiles, spectral band shares, speech-likelihood). Older builds of the
+// script wrote a single average-decibel number, which still parses as a
+// summary with only AvgDB set.
+
+// Audio classes assigned by classifyAudio
+const (
+	audioClassQuiet        = "quiet"
+	audioClassAmbient      = "ambient"
+	audioClassConversation = "conversation"
+	audioClassMusic        = "music"
+)
+
+type AudioPercentiles struct {
+	P10 float64 `json:"p10"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+}
+
+// AudioSummary is the per-sample audio feature set from wili/audio.py.
+type AudioSummary struct {
+	DurationS         float64            `json:"duration_s,omitempty"`
+	SampleRate        float64            `json:"sample_rate,omitempty"`
+	AvgDB             float64            `json:"avg_db"`
+	PeakDB            float64            `json:"peak_db,omitempty"`
+	RMS               float64            `json:"rms,omitempty"`
+	PercentilesDB     *AudioPercentiles  `json:"percentiles_db,omitempty"`
+	ZeroCrossingRate  float64            `json:"zero_crossing_rate,omitempty"`
+	EnvelopeVariation float64            `json:"envelope_variation,omitempty"`
+	SpeechLikelihood  float64            `json:"speech_likelihood"`
+	Bands             map[string]float64 `json:"bands,omitempty"`
+	Class             string             `json:"class,omitempty"`
+}
+
+// readAudio parses an audio.py output file: a JSON summary or, from older
+// scripts, a bare decibel value.
+func readAudio(path string) (AudioSummary, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return AudioSummary{}, err
+	}
+
+	str := strings.TrimSpace(string(data))
+	var sum AudioSummary
+	if strings.HasPrefix(str, "{") {
+		if err := json.Unmarshal([]byte(str), &sum); err != nil {
+			return AudioSummary{}, fmt.Errorf("failed to parse audio summary: %w", err)
+		}
+	} else {
+		val, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return AudioSummary{}, fmt.Errorf("failed to parse float: %w", err)
+		}
+		sum.AvgDB = val
+	}
+	// old audio.py wrote -inf when it got no samples at all
+	if math.IsInf(sum.AvgDB, 0) || math.IsNaN(sum.AvgDB) {
+		return AudioSummary{}, fmt.Errorf("no usable audio level: %s", str)
+	}
+	sum.Class = classifyAudio(sum)
+	return sum, nil
+}
+
+// classifyAudio is a rough label for the study environment. Speech switches
+// on and off at syllable rate (high envelope variation, energy in the voice
+// band); music is loud but steady with energy spread across bands; anything
+// else audible is ambient.
+func classifyAudio(s AudioSummary) string {
+	switch {
+	case s.AvgDB < 45:
+		return audioClassQuiet
+	case s.SpeechLikelihood >= 0.6:
+		return audioClassConversation
+	case s.Bands == nil:
+		// legacy value or monitor level without band features
+		return audioClassAmbient
+	case s.AvgDB >= 55 && s.EnvelopeVariation < 0.5 && s.Bands["low"]+s.Bands["high"] >= 0.35:
+		return audioClassMusic
+	}
+	return audioClassAmbient
+}
+
+// AudioStats summarizes the samples that actually have audio.
+type AudioStats struct {
+	Samples             int            `json:"samples"`
+	Missing             int            `json:"missing"`
+	AvgDecibels         *float64       `json:"avg_decibels"`
+	MaxDecibels         *float64       `json:"max_decibels"`
+	MaxPeakDecibels     *float64       `json:"max_peak_decibels,omitempty"`
+	AvgSpeechLikelihood *float64       `json:"avg_speech_likelihood,omitempty"`
+	Classes             map[string]int `json:"classes,omitempty"`
+}
+
+// audioStats averages over points with fresh audio only.
+func audioStats(points []FocusPoint) AudioStats {
+	var st AudioStats
+	var sum, speech float64
+	var featured int
+	for _, p := range points {
+		if p.Decibels == nil {
+			st.Missing++
+			continue
+		}
+		db := *p.Decibels
+		sum += db
+		if st.MaxDecibels == nil || db > *st.MaxDecibels {
+			st.MaxDecibels = &db
+		}
+		st.Samples++
+		if p.Audio == nil {
+			continue
+		}
+		if st.Classes == nil {
+			st.Classes = map[string]int{}
+		}
+		st.Classes[p.Audio.Class]++
+		if p.Audio.Bands == nil {
+			continue
+		}
+		featured++
+		speech += p.Audio.SpeechLikelihood
+		peak := p.Audio.PeakDB
+		if st.MaxPeakDecibels == nil || peak > *st.MaxPeakDecibels {
+			st.MaxPeakDecibels = &peak
+		}
+	}
+	if st.Samples > 0 {
+		avg := sum / float64(st.Samples)
+		st.AvgDecibels = &avg
+	}
+	if featured > 0 {
+		avg := speech / float64(featured)
+		st.AvgSpeechLikelihood = &avg
+	}
+	return st
+}
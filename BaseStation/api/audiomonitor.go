@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----- Continuous ambient noise monitor -----
+//
+// With audio.monitor on, a long-running `audio.py --stream` child prints one
+// LEVEL line per audio.resolution. Levels are kept in a rolling series
+// covering audio.window. A level audio.spike_delta_db above the recent
+// median (and at least audio.spike_min_db) opens a noise spike, which
+// becomes a NoiseEvent once the level drops back. Events during a session are
+// stored with it next to the focus samples.
+//
+// While the monitor is live it owns the microphone, so samples take their
+// audio summary from the series instead of starting audio.py themselves.
+
+const (
+	defaultMonitorResolution = time.Second
+	defaultMonitorWindow     = 30 * time.Minute
+	defaultSpikeDeltaDB      = 12.0
+	defaultSpikeMinDB        = 55.0
+	// How much history the spike baseline (median level) is taken over.
+	spikeBaselineSpan = 30 * time.Second
+	// Length of the audio window attached to each sample, like audio.py's DURATION.
+	sampleAudioWindow   = 5 * time.Second
+	monitorRestartDelay = 5 * time.Second
+	// How much of the series /api/dash/monolithic carries; /api/audio/levels
+	// has it all.
+	statsLevelSpan = 5 * time.Minute
+)
+
+// LevelPoint is one audio.resolution window of the live series.
+type LevelPoint struct {
+	Time             time.Time `json:"time"`
+	AvgDB            float64   `json:"avg_db"`
+	PeakDB           float64   `json:"peak_db"`
+	SpeechLikelihood float64   `json:"speech_likelihood"`
+}
+
+// NoiseEvent is a burst of sound well above the recent ambient level.
+type NoiseEvent struct {
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	PeakDB     float64   `json:"peak_db"`
+	BaselineDB float64   `json:"baseline_db"`
+}
+
+type audioMonitor struct {
+	python     string // capture.python
+	script     string // audio.py
+	resolution time.Duration
+	window     time.Duration
+	spikeDelta float64
+	spikeMin   float64
+
+	mu      sync.Mutex
+	points  []LevelPoint
+	events  []NoiseEvent
+	spike   *NoiseEvent
+	updated chan struct{} // closed and replaced on every new point
+
+	onLevel func(p LevelPoint, spikeStarted bool) // every level, for triggers
+	onEvent func(NoiseEvent)                      // every finished spike
+	stop    context.CancelFunc                    // ends run and the child
+	done    chan struct{}                         // closed once run has returned
+}
+
+// startAudioMonitor starts the monitor if audio.monitor is enabled and
+// returns it, or nil. A running monitor is stopped and replaced, so a reload
+// can call it again with new settings; the level series starts over.
+func (app *App) startAudioMonitor() *audioMonitor {
+	app.cfgMu.Lock()
+	old := app.audioMon
+	app.audioMon = nil
+	app.cfgMu.Unlock()
+	if old != nil {
+		// One device: the old child has to let go of it first
+		old.stop()
+		<-old.done
+	}
+
+	m := newAudioMonitor(app.config(), app.wiliAudioPath())
+	if m == nil {
+		return nil
+	}
+	m.onLevel = app.observeLevel
+	m.onEvent = app.recordNoiseEvent
+	var ctx context.Context
+	ctx, m.stop = context.WithCancel(app.procCtx)
+	go func() {
+		defer close(m.done)
+		m.run(ctx)
+	}()
+	app.cfgMu.Lock()
+	app.audioMon = m
+	app.cfgMu.Unlock()
+	return m
+}
+
+func newAudioMonitor(cfg Config, script string) *audioMonitor {
+	if !cfg.Audio.Monitor {
+		return nil
+	}
+	return &audioMonitor{
+		python:     cfg.Capture.Python,
+		script:     script,
+		resolution: cfg.Audio.Resolution,
+		window:     cfg.Audio.Window,
+		spikeDelta: cfg.Audio.SpikeDeltaDB,
+		spikeMin:   cfg.Audio.SpikeMinDB,
+		updated:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// run keeps the streaming child alive until ctx ends.
+func (m *audioMonitor) run(ctx context.Context) {
+	for {
+		err := m.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("audio monitor exited (%v), restarting in %s\n", err, monitorRestartDelay)
+		select {
+		case <-time.After(monitorRestartDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *audioMonitor) stream(ctx context.Context) error {
+	res := strconv.FormatFloat(m.resolution.Seconds(), 'f', -1, 64)
+	cmd := exec.CommandContext(ctx, m.python, m.script, "--stream", "--resolution", res)
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start python: %w", err)
+	}
+	// Wait closes the pipes, so the copy has to be done first or the child's
+	// last words (e.g. a traceback) are lost
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		_, _ = io.Copy(os.Stdout, stderr)
+	}()
+	sc := bufio.NewScanner(stdout)
+	for sc.Scan() {
+		line := sc.Text()
+		payload, ok := strings.CutPrefix(line, "LEVEL ")
+		if !ok {
+			fmt.Println(line)
+			continue
+		}
+		var lv struct {
+			T                float64 `json:"t"`
+			AvgDB            float64 `json:"avg_db"`
+			PeakDB           float64 `json:"peak_db"`
+			SpeechLikelihood float64 `json:"speech_likelihood"`
+		}
+		if err := json.Unmarshal([]byte(payload), &lv); err != nil {
+			continue
+		}
+		sec, frac := math.Modf(lv.T)
+		m.add(LevelPoint{Time: time.Unix(int64(sec), int64(frac*1e9)), AvgDB: lv.AvgDB,
+			PeakDB: lv.PeakDB, SpeechLikelihood: lv.SpeechLikelihood})
+	}
+	<-stderrDone
+	return cmd.Wait()
+}
+
+// add appends a level, trims the series to the window and runs spike
+// detection.
+func (m *audioMonitor) add(p LevelPoint) {
+	m.mu.Lock()
+	baseline, haveBaseline := m.baselineLocked(p.Time)
+	m.points = append(m.points, p)
+	cutoff := p.Time.Add(-m.window)
+	i := 0
+	for i < len(m.points) && m.points[i].Time.Before(cutoff) {
+		i++
+	}
+	m.points = m.points[i:]
+	for len(m.events) > 0 && m.events[0].End.Before(cutoff) {
+		m.events = m.events[1:]
+	}
+
+	var finished *NoiseEvent
+	started := false
+	loud := haveBaseline && p.AvgDB >= baseline+m.spikeDelta && p.AvgDB >= m.spikeMin
+	switch {
+	case loud && m.spike == nil:
+		m.spike = &NoiseEvent{Start: p.Time, End: p.Time, PeakDB: p.PeakDB, BaselineDB: baseline}
+		started = true
+	case loud:
+		m.spike.End = p.Time
+		m.spike.PeakDB = math.Max(m.spike.PeakDB, p.PeakDB)
+	case m.spike != nil && p.AvgDB < m.spike.BaselineDB+m.spikeDelta:
+		ev := *m.spike
+		m.spike = nil
+		m.events = append(m.events, ev)
+		finished = &ev
+	}
+	close(m.updated)
+	m.updated = make(chan struct{})
+	m.mu.Unlock()
+
+	if m.onLevel != nil {
+		m.onLevel(p, started)
+	}
+	if finished != nil && m.onEvent != nil {
+		m.onEvent(*finished)
+	}
+}
+
+// baselineLocked is the median level over the span before t, ignoring points
+// inside the current spike. Caller must hold m.mu.
+func (m *audioMonitor) baselineLocked(t time.Time) (float64, bool) {
+	from := t.Add(-spikeBaselineSpan)
+	var vals []float64
+	for _, p := range m.points {
+		if p.Time.Before(from) || (m.spike != nil && !p.Time.Before(m.spike.Start)) {
+			continue
+		}
+		vals = append(vals, p.AvgDB)
+	}
+	// Need a few seconds of history before anything counts as a spike
+	if len(vals) < 3 {
+		return 0, false
+	}
+	sort.Float64s(vals)
+	return vals[len(vals)/2], true
+}
+
+// live reports whether the stream has produced a level recently.
+func (m *audioMonitor) live() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.points) > 0 && time.Since(m.points[len(m.points)-1].Time) < 3*m.resolution
+}
+
+// series returns the levels and finished events since t.
+func (m *audioMonitor) series(since time.Time) ([]LevelPoint, []NoiseEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var pts []LevelPoint
+	for _, p := range m.points {
+		if !p.Time.Before(since) {
+			pts = append(pts, p)
+		}
+	}
+	var evs []NoiseEvent
+	for _, ev := range m.events {
+		if !ev.End.Before(since) {
+			evs = append(evs, ev)
+		}
+	}
+	return pts, evs
+}
+
+// summary waits until the series covers [from, to] and condenses it into an
+// AudioSummary like audio.py would have produced for that window.
+func (m *audioMonitor) summary(ctx context.Context, from, to time.Time) (AudioSummary, error) {
+	deadline := time.NewTimer(time.Until(to) + 3*m.resolution)
+	defer deadline.Stop()
+	for {
+		m.mu.Lock()
+		covered := len(m.points) > 0 && !m.points[len(m.points)-1].Time.Before(to)
+		updated := m.updated
+		m.mu.Unlock()
+		if covered {
+			break
+		}
+		select {
+		case <-updated:
+		case <-deadline.C:
+			return AudioSummary{}, fmt.Errorf("audio monitor produced no levels for %s..%s", from.Format(time.TimeOnly), to.Format(time.TimeOnly))
+		case <-ctx.Done():
+			return AudioSummary{}, ctx.Err()
+		}
+	}
+
+	pts, _ := m.series(from)
+	var energy, speech float64
+	var n int
+	sum := AudioSummary{PeakDB: math.Inf(-1)}
+	for _, p := range pts {
+		if p.Time.After(to) {
+			break
+		}
+		energy += math.Pow(10, p.AvgDB/10)
+		speech += p.SpeechLikelihood
+		sum.PeakDB = math.Max(sum.PeakDB, p.PeakDB)
+		n++
+	}
+	if n == 0 {
+		return AudioSummary{}, fmt.Errorf("audio monitor has no levels in window")
+	}
+	sum.AvgDB = 10 * math.Log10(energy/float64(n))
+	sum.SpeechLikelihood = speech / float64(n)
+	sum.DurationS = to.Sub(from).Seconds()
+	sum.Class = classifyAudio(sum)
+	return sum, nil
+}
+
+// recordNoiseEvent adds a finished spike to the active session's timeline.
+func (app *App) recordNoiseEvent(ev NoiseEvent) {
+	app.mu.Lock()
+	active := app.sessionActive
+	if active {
+		app.noiseEvents = append(app.noiseEvents, ev)
+	}
+	app.mu.Unlock()
+	if !active {
+		return
+	}
+	fmt.Printf("Noise spike %s: peak %.1f dB over %.1f dB baseline\n", ev.Start.Format(time.TimeOnly), ev.PeakDB, ev.BaselineDB)
+	if err := app.saveState(); err != nil {
+		fmt.Printf("saveState failed: %v\n", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ----- Capture coordinator -----
+//
+// There is one FreeWili on the USB bus and one latest.jpg, so only
+// one capture may run at a time. Anyone asking for a sample while a capture is
+// in flight (the scheduler, /api/capture/once, ...) joins it and gets the same
+// result instead of starting a second python process.
+//
+// Every caller waits with its own context (HTTP request, scheduler, job). A
+// caller whose context ends leaves the capture; when the last one has left,
+// the capture's context is cancelled, which kills the python child and aborts
+// the model request. Callers arriving after that start a fresh capture, which
+// waits for the abandoned one to exit.
+
+// sampleResult is the outcome of one capture + audio read + analysis.
+type sampleResult struct {
+	Seq         uint64 // increases per capture; used to record each sample once
+	ImageFile   string
+	Decibels    *float64 // nil if the audio capture failed
+	Audio       *AudioSummary
+	AudioStatus string
+	AudioError  string
+	Analysis    Analysis
+	TakenAt     time.Time // when image and audio capture started
+	Trigger     string    // set by whoever records an out-of-band sample
+}
+
+// Stage names, also used in stageError and job timings.
+const (
+	stageImage    = "image"
+	stageAudio    = "audio"
+	stageAnalysis = "analysis"
+)
+
+// stageError tells callers which step of a sample failed.
+type stageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *stageError) Error() string { return fmt.Sprintf("%s: %v", e.Stage, e.Err) }
+func (e *stageError) Unwrap() error { return e.Err }
+
+func isAnalysisError(err error) bool {
+	var se *stageError
+	return errors.As(err, &se) && se.Stage == stageAnalysis
+}
+
+// StageTiming is how long one step of a capture took.
+type StageTiming struct {
+	Name       string    `json:"name"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end,omitzero"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// captureCall is one capture in flight, shared by everyone who joined it.
+type captureCall struct {
+	done   chan struct{}
+	res    sampleResult
+	err    error
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	stages    []StageTiming
+	waiters   int
+	abandoned bool // everyone left and the capture was cancelled
+}
+
+// Wait blocks until the capture finishes or ctx ends. A caller that gives up
+// leaves the capture.
+func (call *captureCall) Wait(ctx context.Context) (sampleResult, error) {
+	select {
+	case <-call.done:
+		return call.res, call.err
+	case <-ctx.Done():
+		call.leave()
+		return sampleResult{}, ctx.Err()
+	}
+}
+
+// leave drops one waiter and cancels the capture when nobody is left.
+func (call *captureCall) leave() {
+	call.mu.Lock()
+	call.waiters--
+	last := call.waiters <= 0
+	call.abandoned = last
+	call.mu.Unlock()
+	if last {
+		call.cancel()
+	}
+}
+
+// Stages returns the timings so far; the last one has no End while running.
+func (call *captureCall) Stages() []StageTiming {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+	return append([]StageTiming(nil), call.stages...)
+}
+
+// beginStage records the start of a stage and returns a func that ends it.
+func (call *captureCall) beginStage(name string) func() {
+	call.mu.Lock()
+	i := len(call.stages)
+	call.stages = append(call.stages, StageTiming{Name: name, Start: time.Now()})
+	call.mu.Unlock()
+	return func() {
+		call.mu.Lock()
+		st := &call.stages[i]
+		st.End = time.Now()
+		st.DurationMs = st.End.Sub(st.Start).Milliseconds()
+		call.mu.Unlock()
+	}
+}
+
+type captureCoordinator struct {
+	mu       sync.Mutex
+	seq      uint64
+	inflight *captureCall
+}
+
+// Start joins the capture in flight, or starts fn in the background under
+// parent if there is none. joined reports whether an existing capture was
+// returned. The caller must Wait on the returned call.
+func (c *captureCoordinator) Start(parent context.Context, fn func(context.Context, *captureCall) (sampleResult, error)) (call *captureCall, joined bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var prev *captureCall
+	if call = c.inflight; call != nil {
+		call.mu.Lock()
+		live := !call.abandoned
+		if live {
+			call.waiters++
+		}
+		call.mu.Unlock()
+		if live {
+			return call, true
+		}
+		prev = call // cancelled and on its way out
+	}
+	c.seq++
+	seq := c.seq
+	ctx, cancel := context.WithCancel(parent)
+	call = &captureCall{done: make(chan struct{}), cancel: cancel, waiters: 1}
+	c.inflight = call
+	go func() {
+		defer cancel()
+		if prev != nil {
+			// One device: let the abandoned capture's children exit first
+			<-prev.done
+		}
+		res, err := fn(ctx, call)
+		res.Seq = seq
+		call.res, call.err = res, err
+		c.mu.Lock()
+		if c.inflight == call {
+			c.inflight = nil
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	return call, false
+}
+
+// startSample starts (or joins) a sample: image and audio are captured
+// concurrently from the same moment, then the image is analyzed.
+func (app *App) startSample() (*captureCall, bool) {
+	return app.captures.Start(app.procCtx, func(ctx context.Context, call *captureCall) (sampleResult, error) {
+		takenAt := time.Now()
+
+		// The audio window opens alongside the photo; if the image fails we
+		// cancel the audio capture rather than wait for it. An audio failure
+		// doesn't fail the sample, it is recorded as missing audio.
+		audioCtx, cancelAudio := context.WithCancel(ctx)
+		defer cancelAudio()
+		type audioOut struct {
+			sum AudioSummary
+			err error
+		}
+		audioCh := make(chan audioOut, 1)
+		go func() {
+			end := call.beginStage(stageAudio)
+			defer end()
+			if mon := app.monitor(); mon != nil && mon.live() {
+				sum, err := mon.summary(audioCtx, takenAt, takenAt.Add(sampleAudioWindow))
+				audioCh <- audioOut{sum: sum, err: err}
+				return
+			}
+			sum, err := app.capturer().CaptureAudio(audioCtx, takenAt)
+			audioCh <- audioOut{sum: sum, err: err}
+		}()
+
+		end := call.beginStage(stageImage)
+		img, err := app.capturer().CaptureImage(ctx, takenAt)
+		end()
+		if err != nil {
+			cancelAudio()
+			<-audioCh
+			return sampleResult{}, &stageError{Stage: stageImage, Err: err}
+		}
+		audio := <-audioCh
+		res := sampleResult{ImageFile: img, TakenAt: takenAt, AudioStatus: audioOK}
+		if audio.err != nil {
+			fmt.Printf("audio capture failed, sample recorded without audio: %v\n", audio.err)
+			res.AudioStatus = audioFailed
+			res.AudioError = audio.err.Error()
+		} else {
+			db := audio.sum.AvgDB
+			res.Decibels = &db
+			res.Audio = &audio.sum
+		}
+
+		end = call.beginStage(stageAnalysis)
+		defer end()
+		hash, hashErr := frameHash(img)
+		if hashErr != nil {
+			fmt.Printf("frame hash failed, analyzing anyway: %v\n", hashErr)
+		} else if a, ok := app.dedup.reuse(app.config(), hash, takenAt); ok {
+			fmt.Printf("frame within %d bits of %s, reusing its analysis\n", a.HashDistance, a.ReusedFrom)
+			res.Analysis = a
+			return res, nil
+		}
+		a, err := app.analyzeImage(ctx, img)
+		if err != nil {
+			return sampleResult{}, &stageError{Stage: stageAnalysis, Err: err}
+		}
+		if hashErr == nil {
+			app.dedup.remember(hash, a, img, takenAt)
+		}
+		res.Analysis = a
+		return res, nil
+	})
+}
+
+// takeSample runs a sample to completion (or until ctx ends), coalescing with
+// any capture already running.
+func (app *App) takeSample(ctx context.Context) (sampleResult, error) {
+	call, _ := app.startSample()
+	return call.Wait(ctx)
+}
@@ -0,0 +1,50 @@
+// Command fakegemini serves a scripted stand-in for the Gemini API, for
+// running the base station offline:
+//
+//	go run ./cmd/fakegemini -addr :8086 -script replies.json -loop
+//	GEMINI_BASE_URL=http://localhost:8086 go run .
+//
+// The script is a JSON array of fakegemini.Reply. More replies can be queued
+// at runtime by POSTing such an array to /_fake/replies.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"api/fakegemini"
+)
+
+func main() {
+	addr := flag.String("addr", ":8086", "listen address")
+	script := flag.String("script", "", "JSON file with an array of replies")
+	loop := flag.Bool("loop", false, "repeat the script instead of falling back to the default reply")
+	latency := flag.Int("latency-ms", 0, "delay for the default reply")
+	flag.Parse()
+
+	srv := fakegemini.New()
+	if *latency > 0 {
+		def := fakegemini.FocusReply(true, 0.8, false, "Student reading at the desk.")
+		def.DelayMs = *latency
+		srv.SetDefault(def)
+	}
+	if *script != "" {
+		b, err := os.ReadFile(*script)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var replies []fakegemini.Reply
+		if err := json.Unmarshal(b, &replies); err != nil {
+			log.Fatalf("%s: %v", *script, err)
+		}
+		srv.Enqueue(replies...)
+		log.Printf("Loaded %d scripted replies from %s", len(replies), *script)
+	}
+	srv.SetLoop(*loop)
+
+	log.Printf("Fake Gemini listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, srv))
+}
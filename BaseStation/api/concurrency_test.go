@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"api/fakegemini"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TestConcurrentLoad hammers the dashboard, capture, trigger and session
+// endpoints at once while the scheduler runs. Run with -race.
+func TestConcurrentLoad(t *testing.T) {
+	h := newHarness(t)
+	h.configure(func(c *Config) { c.Trigger.Cooldown = 0 })
+	h.startSession()
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan string, 1000)
+	)
+	expect := func(method, path string, ok ...int) {
+		code := h.do(method, path, nil, nil)
+		for _, c := range ok {
+			if code == c {
+				return
+			}
+		}
+		errs <- fmt.Sprintf("%s %s: status %d", method, path, code)
+	}
+	run := func(n int, fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range n {
+				fn(i)
+			}
+		}()
+	}
+
+	for range 4 {
+		run(40, func(i int) {
+			expect(http.MethodGet, "/api/dash/monolithic", http.StatusOK)
+			expect(http.MethodGet, "/api/sessionlist", http.StatusOK)
+			expect(http.MethodGet, "/api/dash/session?datetime="+time.Now().Format(time.RFC3339), http.StatusOK)
+			expect(http.MethodGet, "/api/usage", http.StatusOK)
+		})
+	}
+	run(10, func(i int) {
+		expect(http.MethodPost, "/api/capture/once?wait=true", http.StatusOK)
+	})
+	run(10, func(i int) {
+		expect(http.MethodPost, "/api/capture/once", http.StatusAccepted)
+	})
+	run(20, func(i int) {
+		// 409 while no session is being studied or a trigger is running
+		expect(http.MethodPost, "/api/triggers/webhook", http.StatusAccepted, http.StatusConflict)
+	})
+	run(6, func(i int) {
+		if i%2 == 0 {
+			expect(http.MethodPost, "/api/session/stop", http.StatusOK)
+		} else {
+			expect(http.MethodPost, "/api/session/start", http.StatusOK)
+		}
+		time.Sleep(50 * time.Millisecond)
+	})
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Whatever the interleaving, the state has to add up
+	<-h.app.stopScheduler()
+	st := h.stats()
+	if st.SamplesCount != len(st.FocusHistory) {
+		t.Fatalf("samples_count %d, focus history %d", st.SamplesCount, len(st.FocusHistory))
+	}
+	var starts []time.Time
+	if code := h.do(http.MethodGet, "/api/sessionlist", nil, &starts); code != http.StatusOK || len(starts) == 0 {
+		t.Fatalf("sessionlist: status %d, %v", code, starts)
+	}
+}
+
+// TestSchedulerStartStopRace starts and stops the scheduler from many
+// goroutines; each start must be matched by exactly one running loop.
+func TestSchedulerStartStopRace(t *testing.T) {
+	h := newHarness(t)
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if i%2 == 0 {
+					h.app.startScheduler(h.e)
+				} else {
+					<-h.app.stopScheduler()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	<-h.app.stopScheduler()
+	h.app.schedMu.Lock()
+	defer h.app.schedMu.Unlock()
+	if h.app.tickerStopChan != nil || h.app.schedulerDone != nil {
+		t.Fatal("scheduler still registered after stop")
+	}
+}
+
+// TestCaptureAfterLastWaiterLeft: once everyone has left a capture it is
+// cancelled, and the next caller must get a fresh one rather than join it.
+func TestCaptureAfterLastWaiterLeft(t *testing.T) {
+	var c captureCoordinator
+	release := make(chan struct{})
+	fn := func(ctx context.Context, _ *captureCall) (sampleResult, error) {
+		<-release // a capture that is slow to notice the cancel
+		return sampleResult{}, ctx.Err()
+	}
+	first, _ := c.Start(context.Background(), fn)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := first.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("first wait: %v", err)
+	}
+
+	second, joined := c.Start(context.Background(), func(ctx context.Context, _ *captureCall) (sampleResult, error) {
+		return sampleResult{ImageFile: "fresh.jpg"}, ctx.Err()
+	})
+	if joined {
+		t.Fatal("joined the abandoned capture")
+	}
+	close(release)
+	res, err := second.Wait(context.Background())
+	if err != nil || res.ImageFile != "fresh.jpg" {
+		t.Fatalf("second capture: %+v, %v", res, err)
+	}
+	if third, joined := c.Start(context.Background(), fn); joined {
+		t.Fatal("joined a finished capture")
+	} else {
+		third.Wait(context.Background())
+	}
+}
+
+// A scheduler tick that joined a capture someone else already recorded must
+// still count it for presence.
+func TestPresenceCountsJoinedSample(t *testing.T) {
+	frame := filepath.Join(t.TempDir(), "frame.jpg")
+	writeFrame(t, frame, 0)
+	cfg := DefaultConfig(t.TempDir())
+	cfg.Presence.Mode = presenceModePause
+	cfg.Presence.AwaySamples = 1
+	app := NewApp(cfg)
+	app.Capturer = stubCapturer{frame: frame}
+	app.Analyzer = stubAnalyzer{reply: fakegemini.FocusReply(false, 0, true, "Nobody here.")}
+	t.Cleanup(app.Close)
+	if err := app.beginSession(time.Now(), "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	app.mu.Lock()
+	app.lastRecordedSeq = math.MaxUint64 // as if a manual capture got there first
+	app.mu.Unlock()
+	app.doCaptureCycle(t.Context(), echo.New())
+	if st := app.snapshot(); st.Status != statePaused {
+		t.Fatalf("status = %q after an away sample with presence.away_samples = 1, want %q", st.Status, statePaused)
+	}
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----- Station configuration -----
+//
+// Settings are layered, later layers winning:
+//
+//	built-in defaults < config file < environment < command-line flags
+//
+// The repo root is -root, else BASESTATION_ROOT, else found by looking upwards
+// from the working directory; relative paths are taken from it. Its .env is
+// loaded into the environment first (dotenv.go).
+//
+// The config file is BaseStation/basestation.toml under the repo root, or
+// whatever -config / BASESTATION_CONFIG names. It is a small subset of TOML:
+// [section] headers, key = value, # comments, and string, integer, float and
+// boolean values; durations are strings like "30s". Every key can also be
+// given as a flag named section.key (e.g. -capture.interval=2m) and through
+// the env variable in its env tag.
+//
+// Besides env and help, a key's tags say what validate accepts: numbers must
+// be positive unless tagged optional (then zero is allowed, and an optional
+// string may be empty), oneof lists the allowed strings and max caps an int.
+// secret values are shown as "(set)" in the view.
+//
+// The merged config is validated before anything starts and served read-only
+// at GET /api/config. SIGHUP or POST /api/admin/reload loads it again and
+// applies it to the running station (reload.go); keys tagged restart keep
+// their old value until the next start. What each tuning section does is
+// described in the file that uses it (presence.go, triggers.go, usage.go, ...).
+
+const (
+	configFileRel = "BaseStation/basestation.toml"
+
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+	sourceSearch  = "search" // root found from the working directory
+)
+
+type Config struct {
+	Server struct {
+		Addr       string `json:"addr" env:"BASESTATION_ADDR" restart:"true" help:"HTTP listen address"`
+		AdminToken string `json:"admin_token" env:"ADMIN_TOKEN" optional:"true" secret:"true" help:"X-Admin-Token required by /api/admin/*; empty for none"`
+	} `json:"server"`
+	// Relative paths are taken from the repo root.
+	Paths struct {
+		Images      string `json:"images" env:"IMAGES_DIR" restart:"true" help:"captured images and audio summaries"`
+		Sessions    string `json:"sessions" env:"SESSIONS_DIR" restart:"true" help:"state snapshot, WAL and completed sessions"`
+		Static      string `json:"static" env:"STATIC_DIR" restart:"true" help:"dashboard files served at /"`
+		Prompts     string `json:"prompts" env:"PROMPTS_DIR" restart:"true" help:"analysis prompt templates"`
+		EyeScript   string `json:"eye_script" env:"WILI_EYE_SCRIPT" restart:"true" help:"camera capture script"`
+		AudioScript string `json:"audio_script" env:"WILI_AUDIO_SCRIPT" restart:"true" help:"audio capture script"`
+	} `json:"paths"`
+	Capture struct {
+		Python       string        `json:"python" env:"PYTHON" help:"python interpreter for the capture scripts"`
+		ImageTimeout time.Duration `json:"image_timeout" env:"CAPTURE_IMAGE_TIMEOUT" help:"watchdog for one image capture"`
+		AudioTimeout time.Duration `json:"audio_timeout" env:"CAPTURE_AUDIO_TIMEOUT" help:"watchdog for one audio capture"`
+		Interval     time.Duration `json:"interval" env:"SAMPLE_INTERVAL" help:"time between samples during a session"`
+	} `json:"capture"`
+	Gemini struct {
+		BaseURL string        `json:"base_url" env:"GEMINI_BASE_URL" help:"API base URL, e.g. a fakegemini server"`
+		Model   string        `json:"model" env:"GEMINI_MODEL" help:"model used for analysis"`
+		Timeout time.Duration `json:"timeout" env:"GEMINI_TIMEOUT" help:"HTTP timeout for one model call"`
+		// The key itself never goes in the config; this names a file holding
+		// it, such as a mounted secret. Read for every call, so it can be
+		// rotated in place.
+		APIKeyFile string `json:"api_key_file" env:"GEMINI_API_KEY_FILE" optional:"true" help:"file with the API key (e.g. /run/secrets/gemini_api_key), used instead of $GEMINI_API_KEY"`
+		// USD per million tokens; thinking tokens bill as output
+		PriceInputPerMTok  float64 `json:"price_input_per_mtok" env:"GEMINI_PRICE_INPUT_PER_MTOK" optional:"true" help:"input price, USD per million tokens"`
+		PriceOutputPerMTok float64 `json:"price_output_per_mtok" env:"GEMINI_PRICE_OUTPUT_PER_MTOK" optional:"true" help:"output price, USD per million tokens"`
+	} `json:"gemini"`
+	Prompt struct {
+		ID     string `json:"id" env:"PROMPT_ID" help:"prompt template in paths.prompts"`
+		Device string `json:"device" env:"PROMPT_DEVICE" optional:"true" help:"device-<name>.json layered on top"`
+		User   string `json:"user" env:"PROMPT_USER" optional:"true" help:"user-<name>.json layered on top of that"`
+	} `json:"prompt"`
+	Analysis struct {
+		Retries         int           `json:"retries" env:"ANALYSIS_RETRIES" optional:"true" help:"times a reply failing validation is asked for again"`
+		ContextFrames   int           `json:"context_frames" env:"ANALYSIS_CONTEXT_FRAMES" optional:"true" max:"8" help:"earlier samples sent along as context"`
+		ContextMode     string        `json:"context_mode" env:"ANALYSIS_CONTEXT_MODE" oneof:"summaries,frames" help:"send earlier samples as verdicts or as images"`
+		ContextMaxAge   time.Duration `json:"context_max_age" env:"ANALYSIS_CONTEXT_MAX_AGE" help:"oldest sample sent as context"`
+		SmoothingWindow time.Duration `json:"smoothing_window" env:"FOCUS_SMOOTHING_WINDOW" optional:"true" help:"time constant of smoothed_focus_level; 0 for none"`
+	} `json:"analysis"`
+	Dedup struct {
+		Distance int           `json:"distance" env:"FRAME_DEDUP_DISTANCE" optional:"true" max:"64" help:"hash bits a frame may differ by and reuse the last analysis; 0 for off"`
+		MaxReuse int           `json:"max_reuse" env:"FRAME_DEDUP_MAX_REUSE" optional:"true" help:"reuses in a row before a fresh analysis"`
+		MaxAge   time.Duration `json:"max_age" env:"FRAME_DEDUP_MAX_AGE" help:"analyzed frame age that forces a fresh analysis"`
+	} `json:"dedup"`
+	Budget struct {
+		DailyUSD   float64 `json:"daily_usd" env:"ANALYSIS_BUDGET_DAILY_USD" optional:"true" help:"model spend allowed per day; 0 for no limit"`
+		SessionUSD float64 `json:"session_usd" env:"ANALYSIS_BUDGET_SESSION_USD" optional:"true" help:"model spend allowed per session; 0 for no limit"`
+		Action     string  `json:"action" env:"BUDGET_ACTION" oneof:"slow,stop" help:"over budget, sample less often or stop analysis"`
+		SlowFactor int     `json:"slow_factor" env:"BUDGET_SLOW_FACTOR" help:"interval multiplier when slowed down"`
+	} `json:"budget"`
+	Presence struct {
+		Mode            string        `json:"mode" env:"PRESENCE_MODE" optional:"true" oneof:"pause,stop" help:"what away samples do to a session; empty for nothing"`
+		AwaySamples     int           `json:"away_samples" env:"PRESENCE_AWAY_SAMPLES" help:"consecutive away samples before presence.mode applies"`
+		Standby         bool          `json:"standby" env:"PRESENCE_STANDBY" help:"sample between sessions and start one when someone sits down"`
+		StandbyInterval time.Duration `json:"standby_interval" env:"PRESENCE_STANDBY_INTERVAL" help:"time between samples in standby"`
+	} `json:"presence"`
+	Trigger struct {
+		OnSpike      bool          `json:"on_spike" env:"TRIGGER_ON_SPIKE" help:"sample on a noise spike"`
+		DBThreshold  float64       `json:"db_threshold" env:"TRIGGER_DB_THRESHOLD" optional:"true" help:"sample when the level rises past this many dB; 0 for off"`
+		Cooldown     time.Duration `json:"cooldown" env:"TRIGGER_COOLDOWN" optional:"true" help:"minimum time between triggered samples"`
+		WebhookToken string        `json:"webhook_token" env:"TRIGGER_WEBHOOK_TOKEN" optional:"true" secret:"true" help:"X-Trigger-Token required by the webhook; empty for none"`
+	} `json:"trigger"`
+	Audio struct {
+		Monitor      bool          `json:"monitor" env:"AUDIO_MONITOR" help:"stream ambient levels and detect noise spikes"`
+		Resolution   time.Duration `json:"resolution" env:"AUDIO_MONITOR_RESOLUTION" help:"length of one level point"`
+		Window       time.Duration `json:"window" env:"AUDIO_MONITOR_WINDOW" help:"how much of the level series is kept"`
+		SpikeDeltaDB float64       `json:"spike_delta_db" env:"AUDIO_SPIKE_DELTA_DB" help:"dB over the ambient median that makes a spike"`
+		SpikeMinDB   float64       `json:"spike_min_db" env:"AUDIO_SPIKE_MIN_DB" optional:"true" help:"quietest level that can be a spike"`
+	} `json:"audio"`
+	Session struct {
+		DowntimeGap    time.Duration `json:"downtime_gap" env:"SESSION_DOWNTIME_GAP" optional:"true" help:"silence before a restart records downtime; 0 for 3 sample intervals"`
+		IdleCloseAfter time.Duration `json:"idle_close_after" env:"SESSION_IDLE_CLOSE_AFTER" optional:"true" help:"close a recovered session idle for longer than this; 0 for never"`
+	} `json:"session"`
+	Retention struct {
+		Jobs      time.Duration `json:"jobs" env:"JOB_RETENTION" help:"how long finished capture jobs can be looked up"`
+		UsageDays int           `json:"usage_days" env:"USAGE_DAYS_KEPT" help:"days of per-day model usage kept"`
+	} `json:"retention"`
+
+	Root    string            `json:"root"`               // repo root the paths are relative to
+	File    string            `json:"file,omitempty"`     // config file that was read, if any
+	EnvFile string            `json:"env_file,omitempty"` // .env that was loaded, if any
+	Sources map[string]string `json:"sources,omitzero"`   // where each key's value came from
+
+	args []string // command-line args, applied again on reload
+}
+
+// DefaultConfig is the built-in configuration for a repo root.
+func DefaultConfig(root string) Config {
+	var c Config
+	c.Server.Addr = ":8085"
+	c.Paths.Images = dataImagesRel
+	c.Paths.Sessions = sessionsDirRel
+	c.Paths.Static = staticDirRel
+	c.Paths.Prompts = promptsDirRel
+	c.Paths.EyeScript = wiliEyeScriptRel
+	c.Paths.AudioScript = wiliAudioScriptRel
+	c.Capture.Python = "python3"
+	c.Capture.ImageTimeout = 30 * time.Second
+	c.Capture.AudioTimeout = 30 * time.Second
+	c.Capture.Interval = time.Minute
+	c.Gemini.BaseURL = defaultGeminiBaseURL
+	c.Gemini.Model = defaultGeminiModel
+	c.Gemini.Timeout = 30 * time.Second
+	c.Gemini.PriceInputPerMTok = defaultPriceInputPerMTok
+	c.Gemini.PriceOutputPerMTok = defaultPriceOutputPerMTok
+	c.Prompt.ID = defaultPromptID
+	c.Analysis.Retries = defaultAnalysisRetries
+	c.Analysis.ContextMode = contextModeSummaries
+	c.Analysis.ContextMaxAge = defaultContextMaxAge
+	c.Analysis.SmoothingWindow = defaultSmoothingWindow
+	c.Dedup.Distance = defaultDedupDistance
+	c.Dedup.MaxReuse = defaultDedupMaxReuse
+	c.Dedup.MaxAge = defaultDedupMaxAge
+	c.Budget.Action = budgetActionSlow
+	c.Budget.SlowFactor = defaultBudgetSlowFactor
+	c.Presence.AwaySamples = defaultAwaySamples
+	c.Presence.StandbyInterval = defaultStandbyInterval
+	c.Trigger.Cooldown = defaultTriggerCooldown
+	c.Audio.Resolution = defaultMonitorResolution
+	c.Audio.Window = defaultMonitorWindow
+	c.Audio.SpikeDeltaDB = defaultSpikeDeltaDB
+	c.Audio.SpikeMinDB = defaultSpikeMinDB
+	c.Retention.Jobs = jobRetention
+	c.Retention.UsageDays = usageDaysKept
+	c.Root = root
+	return c
+}
+
+// path resolves a configured path against the repo root.
+func (c Config) path(p string) string {
+	if filepath.IsAbs(p) || c.Root == "" {
+		return p
+	}
+	return filepath.Join(c.Root, p)
+}
+
+// configField is one settable key, e.g. capture.interval.
+type configField struct {
+	key     string
+	env     string
+	help    string
+	restart bool // only takes effect on the next start
+	opt     bool // may be zero or empty
+	secret  bool
+	oneof   []string
+	max     int // ints only; 0 for no cap
+	v       reflect.Value
+}
+
+// fields lists the settable keys of c in declaration order.
+func (c *Config) fields() []configField {
+	var out []configField
+	cv := reflect.ValueOf(c).Elem()
+	ct := cv.Type()
+	for i := range ct.NumField() {
+		sec := ct.Field(i)
+		if sec.Type.Kind() != reflect.Struct {
+			continue
+		}
+		prefix := jsonName(sec)
+		for j := range sec.Type.NumField() {
+			f := sec.Type.Field(j)
+			var oneof []string
+			if s := f.Tag.Get("oneof"); s != "" {
+				oneof = strings.Split(s, ",")
+			}
+			max, _ := strconv.Atoi(f.Tag.Get("max"))
+			out = append(out, configField{
+				key:     prefix + "." + jsonName(f),
+				env:     f.Tag.Get("env"),
+				help:    f.Tag.Get("help"),
+				restart: f.Tag.Get("restart") == "true",
+				opt:     f.Tag.Get("optional") == "true",
+				secret:  f.Tag.Get("secret") == "true",
+				oneof:   oneof,
+				max:     max,
+				v:       cv.Field(i).Field(j),
+			})
+		}
+	}
+	return out
+}
+
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return name
+}
+
+// setString parses s into the field's type.
+func (f configField) setString(s string) error {
+	switch f.v.Interface().(type) {
+	case string:
+		f.v.SetString(s)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetInt(int64(d))
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetInt(int64(n))
+	case float64:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.v.SetFloat(x)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", f.v.Type())
+	}
+	return nil
+}
+
+// setValue assigns a value read from the config file.
+func (f configField) setValue(v any) error {
+	if s, ok := v.(string); ok {
+		if _, isString := f.v.Interface().(string); isString {
+			f.v.SetString(s)
+			return nil
+		}
+		if _, isDur := f.v.Interface().(time.Duration); isDur {
+			return f.setString(s)
+		}
+	}
+	switch f.v.Interface().(type) {
+	case int:
+		if n, ok := v.(int64); ok {
+			f.v.SetInt(n)
+			return nil
+		}
+	case float64:
+		switch n := v.(type) {
+		case int64:
+			f.v.SetFloat(float64(n))
+			return nil
+		case float64:
+			f.v.SetFloat(n)
+			return nil
+		}
+	case bool:
+		if b, ok := v.(bool); ok {
+			f.v.SetBool(b)
+			return nil
+		}
+	}
+	want := f.v.Type().String()
+	if want == "time.Duration" {
+		want = `duration string like "30s"`
+	}
+	return fmt.Errorf("want %s, got %T", want, v)
+}
+
+// loadConfig builds the configuration from the .env and config files, the
+// environment and the command-line args, and validates it. root is the repo
+// root unless -root or BASESTATION_ROOT names another; if all are empty it is
+// searched for.
+func loadConfig(root string, args []string) (Config, error) {
+	c := DefaultConfig(root)
+	c.args = args
+	fields := c.fields()
+	c.Sources = map[string]string{"root": sourceDefault}
+	for _, f := range fields {
+		c.Sources[f.key] = sourceDefault
+	}
+
+	fs := flag.NewFlagSet("basestation", flag.ContinueOnError)
+	rootFlag := fs.String("root", "", "repo root that relative paths are taken from ($BASESTATION_ROOT)")
+	configPath := fs.String("config", "", "config file (default "+configFileRel+" under the repo root, or $BASESTATION_CONFIG)")
+	flagVals := map[string]*string{}
+	for _, f := range fields {
+		usage := f.help
+		if f.env != "" {
+			usage += " ($" + f.env + ")"
+		}
+		flagVals[f.key] = fs.String(f.key, "", usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	switch {
+	case *rootFlag != "":
+		c.Root, c.Sources["root"] = *rootFlag, sourceFlag
+	case os.Getenv("BASESTATION_ROOT") != "":
+		c.Root, c.Sources["root"] = os.Getenv("BASESTATION_ROOT"), sourceEnv
+	case c.Root == "":
+		c.Root, c.Sources["root"] = findRepoRoot(), sourceSearch
+		if c.Root == "" {
+			return c, errors.New("config: repo root not found; pass -root or set BASESTATION_ROOT")
+		}
+	}
+	if abs, err := filepath.Abs(c.Root); err == nil {
+		c.Root = abs
+	}
+	if fi, err := os.Stat(c.Root); err != nil || !fi.IsDir() {
+		return c, fmt.Errorf("config: repo root %s is not a directory", c.Root)
+	}
+
+	envFile := filepath.Join(c.Root, ".env")
+	if _, err := loadDotEnv(envFile); err == nil {
+		c.EnvFile = envFile
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return c, fmt.Errorf("config: %w", err)
+	}
+
+	// File: an explicitly named one must exist, the default one may not
+	path, explicit := *configPath, *configPath != ""
+	if !explicit {
+		path, explicit = os.Getenv("BASESTATION_CONFIG"), os.Getenv("BASESTATION_CONFIG") != ""
+	}
+	if !explicit {
+		path = c.path(configFileRel)
+	}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := c.applyFile(path, string(b), fields); err != nil {
+			return c, err
+		}
+		c.File = path
+	} else if explicit || !errors.Is(err, os.ErrNotExist) {
+		return c, fmt.Errorf("config: %w", err)
+	}
+
+	for _, f := range fields {
+		if v := os.Getenv(f.env); f.env != "" && v != "" {
+			if err := f.setString(v); err != nil {
+				return c, fmt.Errorf("config: $%s: %w", f.env, err)
+			}
+			c.Sources[f.key] = sourceEnv
+		}
+	}
+	var flagErr error
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range fields {
+			if f.key != fl.Name || flagErr != nil {
+				continue
+			}
+			if err := f.setString(*flagVals[f.key]); err != nil {
+				flagErr = fmt.Errorf("config: -%s: %w", f.key, err)
+			}
+			c.Sources[f.key] = sourceFlag
+		}
+	})
+	if flagErr != nil {
+		return c, flagErr
+	}
+	if err := c.validate(); err != nil {
+		return c, fmt.Errorf("config: %w", err)
+	}
+	return c, nil
+}
+
+// applyFile sets the keys found in a config file.
+func (c *Config) applyFile(path, data string, fields []configField) error {
+	values, err := parseConfigFile(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for key, v := range values {
+		i := fieldIndex(fields, key)
+		if i < 0 {
+			return fmt.Errorf("%s:%d: unknown key %s", path, v.line, key)
+		}
+		if err := fields[i].setValue(v.val); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, v.line, key, err)
+		}
+		c.Sources[key] = sourceFile
+	}
+	return nil
+}
+
+func fieldIndex(fields []configField, key string) int {
+	for i, f := range fields {
+		if f.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c Config) validate() error {
+	var errs []error
+	if _, port, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("server.addr: %w", err))
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		errs = append(errs, fmt.Errorf("server.addr: bad port %q", port))
+	}
+	for _, f := range c.fields() {
+		if err := f.check(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.key, err))
+		}
+	}
+	if p := c.Gemini.APIKeyFile; p != "" {
+		if _, err := os.Stat(c.path(p)); err != nil {
+			errs = append(errs, fmt.Errorf("gemini.api_key_file: %w", err))
+		}
+	}
+	if u, err := url.Parse(c.Gemini.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("gemini.base_url: want an http(s) URL, got %q", c.Gemini.BaseURL))
+	}
+	return errors.Join(errs...)
+}
+
+// check applies the field's validation tags to its value.
+func (f configField) check() error {
+	switch v := f.v.Interface().(type) {
+	case string:
+		switch {
+		case v == "" && f.opt:
+		case v == "":
+			return errors.New("must not be empty")
+		case f.oneof != nil && !slices.Contains(f.oneof, v):
+			return fmt.Errorf("want one of %s, got %q", strings.Join(f.oneof, ", "), v)
+		}
+	case time.Duration:
+		if v < 0 || (v == 0 && !f.opt) {
+			return fmt.Errorf("must be positive, got %s", v)
+		}
+	case int:
+		if v < 0 || (v == 0 && !f.opt) {
+			return fmt.Errorf("must be positive, got %d", v)
+		}
+		if f.max > 0 && v > f.max {
+			return fmt.Errorf("at most %d, got %d", f.max, v)
+		}
+	case float64:
+		if v < 0 || (v == 0 && !f.opt) {
+			return fmt.Errorf("must be positive, got %g", v)
+		}
+	}
+	return nil
+}
+
+// ----- Config file parsing -----
+
+type configValue struct {
+	val  any // string, int64, float64 or bool
+	line int
+}
+
+// parseConfigFile reads the TOML subset described above into dotted keys.
+func parseConfigFile(data string) (map[string]configValue, error) {
+	out := map[string]configValue{}
+	section := ""
+	for i, raw := range strings.Split(data, "\n") {
+		n := i + 1
+		line := strings.TrimSpace(stripComment(raw))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: bad section header %q", n, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section == "" {
+				return nil, fmt.Errorf("line %d: empty section name", n)
+			}
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: want key = value", n)
+		}
+		key := strings.TrimSpace(k)
+		if key == "" || strings.ContainsAny(key, " \t\"'") {
+			return nil, fmt.Errorf("line %d: bad key %q", n, key)
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+		if _, dup := out[key]; dup {
+			return nil, fmt.Errorf("line %d: %s set twice", n, key)
+		}
+		val, err := parseConfigValue(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, key, err)
+		}
+		out[key] = configValue{val: val, line: n}
+	}
+	return out, nil
+}
+
+// stripComment drops a # comment that is not inside a string.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func parseConfigValue(s string) (any, error) {
+	switch {
+	case s == "":
+		return nil, errors.New("missing value")
+	case s[0] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' || strings.Contains(s[1:len(s)-1], "'") {
+			return nil, fmt.Errorf("bad literal string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s == "true" || s == "false":
+		return s == "true", nil
+	}
+	num := strings.ReplaceAll(s, "_", "")
+	if n, err := strconv.ParseInt(num, 10, 64); err == nil {
+		return n, nil
+	}
+	if x, err := strconv.ParseFloat(num, 64); err == nil {
+		return x, nil
+	}
+	return nil, fmt.Errorf("bad value %s (strings must be quoted)", s)
+}
+
+// view is the config as served by /api/config, durations as strings and
+// secrets hidden.
+func (c Config) view() map[string]any {
+	out := map[string]any{"root": c.Root, "sources": c.Sources}
+	if c.File != "" {
+		out["file"] = c.File
+	}
+	if c.EnvFile != "" {
+		out["env_file"] = c.EnvFile
+	}
+	for _, f := range c.fields() {
+		sec, key, _ := strings.Cut(f.key, ".")
+		m, _ := out[sec].(map[string]any)
+		if m == nil {
+			m = map[string]any{}
+			out[sec] = m
+		}
+		if d, ok := f.v.Interface().(time.Duration); ok {
+			m[key] = d.String()
+		} else if f.secret && f.v.String() != "" {
+			m[key] = "(set)"
+		} else {
+			m[key] = f.v.Interface()
+		}
+	}
+	return out
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig puts a basestation.toml at its default place under root.
+func writeConfig(t *testing.T, root, data string) string {
+	t.Helper()
+	path := filepath.Join(root, configFileRel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	root := t.TempDir()
+	for _, env := range []string{"BASESTATION_CONFIG", "BASESTATION_ADDR", "SAMPLE_INTERVAL", "GEMINI_MODEL", "GEMINI_BASE_URL"} {
+		t.Setenv(env, "")
+	}
+	path := writeConfig(t, root, `
+# station settings
+[server]
+addr = "127.0.0.1:9000"
+
+[capture]
+interval = "2m"   # slower than the default
+python = '/usr/bin/python3'
+
+[gemini]
+model = "from-file"
+`)
+	t.Setenv("GEMINI_MODEL", "from-env")
+	t.Setenv("SAMPLE_INTERVAL", "3m")
+
+	cfg, err := loadConfig(root, []string{"-capture.interval=90s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.File != path {
+		t.Errorf("file = %q, want %q", cfg.File, path)
+	}
+	checks := []struct {
+		key, source string
+		got, want   any
+	}{
+		{"server.addr", sourceFile, cfg.Server.Addr, "127.0.0.1:9000"},
+		{"capture.python", sourceFile, cfg.Capture.Python, "/usr/bin/python3"},
+		{"gemini.model", sourceEnv, cfg.Gemini.Model, "from-env"},
+		{"capture.interval", sourceFlag, cfg.Capture.Interval, 90 * time.Second},
+		{"gemini.timeout", sourceDefault, cfg.Gemini.Timeout, 30 * time.Second},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %v, want %v", c.key, c.got, c.want)
+		}
+		if got := cfg.Sources[c.key]; got != c.source {
+			t.Errorf("%s source = %q, want %q", c.key, got, c.source)
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	t.Setenv("BASESTATION_CONFIG", "")
+	for _, env := range []string{"BASESTATION_ADDR", "SAMPLE_INTERVAL", "GEMINI_BASE_URL"} {
+		t.Setenv(env, "")
+	}
+	cases := []struct {
+		name, file string
+		args       []string
+		want       string
+	}{
+		{"unknown key", "[capture]\nintervall = \"2m\"\n", nil, "basestation.toml:2: unknown key capture.intervall"},
+		{"wrong type", "[capture]\ninterval = 5\n", nil, `capture.interval: want duration string like "30s"`},
+		{"unquoted string", "[gemini]\nmodel = flash\n", nil, "line 2: gemini.model: bad value flash"},
+		{"duplicate key", "[server]\naddr = \":1\"\naddr = \":2\"\n", nil, "line 3: server.addr set twice"},
+		{"bad addr", "", []string{"-server.addr=localhost"}, "server.addr:"},
+		{"zero duration", "", []string{"-gemini.timeout=0s"}, "gemini.timeout: must be positive"},
+		{"not one of", "", []string{"-budget.action=pause"}, `budget.action: want one of slow, stop, got "pause"`},
+		{"over max", "", []string{"-analysis.context_frames=9"}, "analysis.context_frames: at most 8"},
+		{"negative optional", "[trigger]\ncooldown = \"-1s\"\n", nil, "trigger.cooldown: must be positive"},
+		{"bad base url", "[gemini]\nbase_url = \"localhost:8080\"\n", nil, "gemini.base_url: want an http(s) URL"},
+		{"missing explicit file", "", []string{"-config=nope.toml"}, "nope.toml"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root := t.TempDir()
+			if c.file != "" {
+				writeConfig(t, root, c.file)
+			}
+			_, err := loadConfig(root, c.args)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("err = %v, want it to contain %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestConfigEndpoint(t *testing.T) {
+	h := newHarness(t)
+	h.configure(func(c *Config) { c.Server.AdminToken = "hunter2" })
+	var got struct {
+		Server  map[string]any    `json:"server"`
+		Capture map[string]any    `json:"capture"`
+		Gemini  map[string]any    `json:"gemini"`
+		Sources map[string]string `json:"sources"`
+	}
+	if code := h.do(http.MethodGet, "/api/config", nil, &got); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if got.Capture["interval"] != h.app.cfg.Capture.Interval.String() {
+		t.Errorf("capture.interval = %v, want %s", got.Capture["interval"], h.app.cfg.Capture.Interval)
+	}
+	if want := os.Getenv("GEMINI_BASE_URL"); got.Gemini["base_url"] != want || got.Sources["gemini.base_url"] != sourceEnv {
+		t.Errorf("gemini.base_url = %v (%s), want %s from env", got.Gemini["base_url"], got.Sources["gemini.base_url"], want)
+	}
+	if got.Server["admin_token"] != "(set)" {
+		t.Errorf("server.admin_token = %v, want it hidden", got.Server["admin_token"])
+	}
+}
+
+// The example config documents the defaults; keep the two in sync.
+func TestConfigExampleMatchesDefaults(t *testing.T) {
+	data, err := os.ReadFile("../basestation.example.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, want := DefaultConfig(""), DefaultConfig("")
+	got.Sources = map[string]string{}
+	if err := got.applyFile("basestation.example.toml", string(data), got.fields()); err != nil {
+		t.Fatal(err)
+	}
+	got.Sources = nil
+	if !reflect.DeepEqual(got.view(), want.view()) {
+		t.Errorf("example config = %v, want the defaults %v", got.view(), want.view())
+	}
+}
+
+func TestConfigRoot(t *testing.T) {
+	given, env, flagged := t.TempDir(), t.TempDir(), t.TempDir()
+	t.Setenv("BASESTATION_CONFIG", "")
+	t.Setenv("BASESTATION_ROOT", "")
+	for _, c := range []struct {
+		env  string
+		args []string
+		want string
+		src  string
+	}{
+		{"", nil, given, sourceDefault},
+		{env, nil, env, sourceEnv},
+		{env, []string{"-root", flagged}, flagged, sourceFlag},
+	} {
+		t.Setenv("BASESTATION_ROOT", c.env)
+		cfg, err := loadConfig(given, c.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Root != c.want || cfg.Sources["root"] != c.src {
+			t.Errorf("env %q, args %v: root %s (%s), want %s (%s)", c.env, c.args, cfg.Root, cfg.Sources["root"], c.want, c.src)
+		}
+	}
+
+	t.Setenv("BASESTATION_ROOT", "")
+	if _, err := loadConfig("", []string{"-root", filepath.Join(given, "missing")}); err == nil {
+		t.Error("loadConfig with a missing root: no error")
+	}
+}
+
+func TestConfigLoadsDotEnv(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("BASESTATION_CONFIG", "")
+	t.Setenv("BASESTATION_ROOT", "")
+	t.Setenv("GEMINI_MODEL", "")
+	os.Unsetenv("GEMINI_MODEL")
+	envFile := filepath.Join(root, ".env")
+	if err := os.WriteFile(envFile, []byte("export GEMINI_MODEL=\"from-dotenv\" # model\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.EnvFile != envFile || cfg.Gemini.Model != "from-dotenv" || cfg.Sources["gemini.model"] != sourceEnv {
+		t.Errorf("env file %q, gemini.model %q (%s), want %s to set it", cfg.EnvFile, cfg.Gemini.Model, cfg.Sources["gemini.model"], envFile)
+	}
+
+	if err := os.WriteFile(envFile, []byte("GEMINI_MODEL=\"unterminated\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(root, nil); err == nil || !strings.Contains(err.Error(), ".env") {
+		t.Errorf("bad .env: err = %v", err)
+	}
+}
+
+func TestAPIKeyFile(t *testing.T) {
+	h := newHarness(t)
+	t.Setenv("GEMINI_API_KEY", "from-env")
+	keyFile := filepath.Join(h.root, "secrets", "gemini_api_key")
+	writeFile(t, keyFile, "from-file\n")
+
+	t.Setenv("GEMINI_API_KEY_FILE", filepath.Join(h.root, "secrets", "missing"))
+	if _, err := loadConfig(h.root, nil); err == nil || !strings.Contains(err.Error(), "gemini.api_key_file") {
+		t.Errorf("missing key file: err = %v", err)
+	}
+
+	t.Setenv("GEMINI_API_KEY_FILE", keyFile)
+	h.restart()
+	if code := h.do(http.MethodPost, "/api/capture/once?wait=true", nil, nil); code != http.StatusOK {
+		t.Fatalf("capture: status %d", code)
+	}
+	reqs := h.gemini.Requests()
+	if got := reqs[len(reqs)-1].Key; got != "from-file" {
+		t.Errorf("API key sent = %q, want the one from the key file", got)
+	}
+	var view struct {
+		Gemini map[string]any `json:"gemini"`
+	}
+	h.do(http.MethodGet, "/api/config", nil, &view)
+	if view.Gemini["api_key_file"] != keyFile {
+		t.Errorf("gemini.api_key_file = %v, want %s", view.Gemini["api_key_file"], keyFile)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ----- Near-duplicate frame detection -----
+//
+// Someone sitting still produces nearly identical frames. Each analyzed frame
+// gets a 64-bit difference hash (dHash); when the next frame's hash is within
+// dedup.distance bits of it, the previous Analysis is reused instead of
+// calling the model. A distance of 0 turns this off. A fresh analysis is
+// forced after dedup.max_reuse reuses in a row or once the analyzed frame is
+// older than dedup.max_age, so slow changes aren't missed.
+
+const (
+	defaultDedupDistance = 4
+	defaultDedupMaxReuse = 5
+	defaultDedupMaxAge   = 10 * time.Minute
+)
+
+type dedupCache struct {
+	mu        sync.Mutex
+	hash      uint64
+	analysis  Analysis
+	imageFile string
+	at        time.Time
+	reuses    int
+	valid     bool
+}
+
+// frameHash is the dHash of a JPEG: the image shrunk to 9x8 grey cells, one
+// bit per horizontally adjacent pair saying whether brightness increases.
+func frameHash(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, fmt.Errorf("decode %s: %w", filepath.Base(path), err)
+	}
+
+	const w, h = 9, 8
+	var sum [h][w]float64
+	var n [h][w]int
+	b := img.Bounds()
+	if b.Dx() < w || b.Dy() < h {
+		return 0, fmt.Errorf("image too small to hash: %dx%d", b.Dx(), b.Dy())
+	}
+	luma := func(x, y int) float64 {
+		r, g, bl, _ := img.At(x, y).RGBA()
+		return 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+	}
+	if ycc, ok := img.(*image.YCbCr); ok {
+		// JPEGs decode to YCbCr; reading Y directly is much faster than At
+		luma = func(x, y int) float64 { return float64(ycc.Y[ycc.YOffset(x, y)]) }
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		cy := (y - b.Min.Y) * h / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x++ {
+			cx := (x - b.Min.X) * w / b.Dx()
+			sum[cy][cx] += luma(x, y)
+			n[cy][cx]++
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			left := sum[y][x] / float64(n[y][x])
+			right := sum[y][x+1] / float64(n[y][x+1])
+			hash <<= 1
+			if right > left {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// reuse returns the cached Analysis, marked as reused, if hash is close
+// enough to the last analyzed frame under cfg's dedup settings.
+func (c *dedupCache) reuse(cfg Config, hash uint64, now time.Time) (Analysis, bool) {
+	maxDist := cfg.Dedup.Distance
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if maxDist == 0 || !c.valid || c.reuses >= cfg.Dedup.MaxReuse || now.Sub(c.at) > cfg.Dedup.MaxAge {
+		return Analysis{}, false
+	}
+	dist := bits.OnesCount64(hash ^ c.hash)
+	if dist > maxDist {
+		return Analysis{}, false
+	}
+	c.reuses++
+	a := c.analysis
+	a.Usage = nil // no model call this time
+	a.ReusedFrom = filepath.Base(c.imageFile)
+	a.HashDistance = dist
+	return a, true
+}
+
+// remember makes a freshly analyzed frame the reference.
+func (c *dedupCache) remember(hash uint64, a Analysis, imageFile string, at time.Time) {
+	c.mu.Lock()
+	c.hash, c.analysis, c.imageFile, c.at = hash, a, imageFile, at
+	c.reuses = 0
+	c.valid = true
+	c.mu.Unlock()
+}
+
+// reset forgets the reference frame, e.g. when a new session starts.
+func (c *dedupCache) reset() {
+	c.mu.Lock()
+	c.valid = false
+	c.mu.Unlock()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ----- .env files -----
+//
+// loadConfig reads <root>/.env for settings that are not in the environment
+// already. Values an earlier load took from the file are not the environment's
+// own, so a reload sets them again: changed values take effect and keys
+// removed from the file (or the whole file) are unset. The format is the
+// common shell-like one:
+//
+//	# comment
+//	export GEMINI_MODEL=gemini-2.5-flash   # "export " is optional
+//	PROMPT_USER = alice                    # unquoted, ends at " #"
+//	GREETING="say \"hi\"\n"                # escapes: \n \r \t \" \\ \$
+//	RAW='no $escapes \here'                # literal
+//	NOTE="first line
+//	second line"                           # quoted values may span lines
+//
+// Later assignments of a key win. Anything else is an error with its line
+// number, and a file with errors sets nothing.
+
+// envVar is one assignment from a .env file.
+type envVar struct {
+	Key, Value string
+	Line       int
+}
+
+// dotEnvSet is what the last loadDotEnv set, key to value. A variable still
+// holding that value came from the file; one changed since belongs to
+// whoever changed it.
+var dotEnvSet struct {
+	sync.Mutex
+	vars map[string]string
+}
+
+// fromDotEnv reports whether key holds the value the last load set. Caller
+// must hold dotEnvSet.
+func fromDotEnv(key string) bool {
+	v, ok := dotEnvSet.vars[key]
+	cur, isSet := os.LookupEnv(key)
+	return ok && isSet && cur == v
+}
+
+// loadDotEnv sets the variables from the .env file at path that are not set
+// already, or were set by an earlier load, and returns how many it set.
+// Variables an earlier load set that the file no longer has are unset, also
+// when the file is gone.
+func loadDotEnv(path string) (int, error) {
+	dotEnvSet.Lock()
+	defer dotEnvSet.Unlock()
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		for k := range dotEnvSet.vars {
+			if fromDotEnv(k) {
+				os.Unsetenv(k)
+			}
+		}
+		dotEnvSet.vars = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	vars, err := parseDotEnv(string(b))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	set := map[string]string{}
+	for _, v := range vars {
+		_, again := set[v.Key]
+		if _, ok := os.LookupEnv(v.Key); ok && !again && !fromDotEnv(v.Key) {
+			continue // the environment wins over the file
+		}
+		if err := os.Setenv(v.Key, v.Value); err != nil {
+			return 0, fmt.Errorf("%s:%d: %w", path, v.Line, err)
+		}
+		set[v.Key] = v.Value
+	}
+	for k := range dotEnvSet.vars {
+		if _, ok := set[k]; !ok && fromDotEnv(k) {
+			os.Unsetenv(k)
+		}
+	}
+	dotEnvSet.vars = set
+	return len(set), nil
+}
+
+// parseDotEnv reads the assignments in a .env file, in order.
+func parseDotEnv(data string) ([]envVar, error) {
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	var out []envVar
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "export"); ok && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+			line = strings.TrimSpace(rest)
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: want KEY=value", n)
+		}
+		key := strings.TrimSpace(k)
+		if !validEnvKey(key) {
+			return nil, fmt.Errorf("line %d: bad variable name %q", n, key)
+		}
+		v = strings.TrimLeft(v, " \t")
+
+		var val string
+		switch {
+		case v == "":
+		case v[0] == '"' || v[0] == '\'':
+			// A quoted value runs on over the following lines until it is closed
+			quote := v[0]
+			text := v[1:]
+			end := closingQuote(text, quote)
+			for end < 0 && i+1 < len(lines) {
+				i++
+				text += "\n" + lines[i]
+				end = closingQuote(text, quote)
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: %s: unterminated %c quote", n, key, quote)
+			}
+			if tail := strings.TrimSpace(text[end+1:]); tail != "" && tail[0] != '#' {
+				return nil, fmt.Errorf("line %d: %s: unexpected %q after the closing quote", n, key, tail)
+			}
+			val = text[:end]
+			if quote == '"' {
+				val = unescapeDotEnv(val)
+			}
+		default:
+			// Unquoted: a # after whitespace starts a comment
+			if c := strings.Index(v, " #"); c >= 0 {
+				v = v[:c]
+			}
+			if c := strings.Index(v, "\t#"); c >= 0 {
+				v = v[:c]
+			}
+			val = strings.TrimSpace(v)
+		}
+		out = append(out, envVar{Key: key, Value: val, Line: n})
+	}
+	return out, nil
+}
+
+func validEnvKey(k string) bool {
+	if k == "" || (k[0] >= '0' && k[0] <= '9') {
+		return false
+	}
+	for _, c := range k {
+		if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// closingQuote is the index of the quote that ends s, or -1. Inside double
+// quotes a backslash escapes the next character.
+func closingQuote(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case s[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// unescapeDotEnv resolves the escapes of a double-quoted value. Unknown
+// escapes are kept as written.
+func unescapeDotEnv(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '"', '\\', '$':
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
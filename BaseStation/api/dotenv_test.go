@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseDotEnv(t *testing.T) {
+	data := "# a comment\r\n" +
+		"\n" +
+		"export MODEL=gemini-2.5-flash\n" +
+		"  PLAIN = some value   # trailing comment\n" +
+		"HASH=a#b\n" +
+		"EMPTY=\n" +
+		`ESCAPED="say \"hi\"\tnow\n\$HOME \q"` + "\n" +
+		`RAW='keep \n "as is" # here' # comment` + "\n" +
+		"MULTI=\"first line\n" +
+		"second line\" # done\n" +
+		"MODEL=override\n"
+	got, err := parseDotEnv(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []envVar{
+		{"MODEL", "gemini-2.5-flash", 3},
+		{"PLAIN", "some value", 4},
+		{"HASH", "a#b", 5},
+		{"EMPTY", "", 6},
+		{"ESCAPED", "say \"hi\"\tnow\n$HOME \\q", 7},
+		{"RAW", `keep \n "as is" # here`, 8},
+		{"MULTI", "first line\nsecond line", 9},
+		{"MODEL", "override", 11},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+}
+
+func TestParseDotEnvErrors(t *testing.T) {
+	cases := []struct{ data, want string }{
+		{"FOO\n", "line 1: want KEY=value"},
+		{"\n1FOO=x\n", "line 2: bad variable name"},
+		{"BAD-KEY=x\n", "line 1: bad variable name"},
+		{"A=1\nB=\"open\nstill open\n", `line 2: B: unterminated " quote`},
+		{"C='x' y\n", "line 1: C: unexpected"},
+	}
+	for _, c := range cases {
+		_, err := parseDotEnv(c.data)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: err = %v, want %q", c.data, err, c.want)
+		}
+	}
+}
+
+func TestLoadDotEnvKeepsEnvironment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte("DOTENV_TEST_SET=from-file\nDOTENV_TEST_NEW=first\nDOTENV_TEST_NEW=second\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DOTENV_TEST_SET", "from-env")
+	t.Setenv("DOTENV_TEST_NEW", "")
+	os.Unsetenv("DOTENV_TEST_NEW")
+
+	n, err := loadDotEnv(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("set %d variables, want 1", n)
+	}
+	if got := os.Getenv("DOTENV_TEST_SET"); got != "from-env" {
+		t.Errorf("DOTENV_TEST_SET = %q, want the environment's from-env", got)
+	}
+	if got := os.Getenv("DOTENV_TEST_NEW"); got != "second" {
+		t.Errorf("DOTENV_TEST_NEW = %q, want the last assignment", got)
+	}
+}
+
+func TestLoadDotEnvAgain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	t.Setenv("DOTENV_TEST_SET", "from-env")
+	t.Setenv("DOTENV_TEST_NEW", "")
+	os.Unsetenv("DOTENV_TEST_NEW")
+	load := func(data string) {
+		t.Helper()
+		if data == "" {
+			os.Remove(path)
+		} else if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadDotEnv(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+	}
+
+	load("DOTENV_TEST_SET=from-file\nDOTENV_TEST_NEW=first\n")
+	load("DOTENV_TEST_SET=from-file\nDOTENV_TEST_NEW=changed\n")
+	if got := os.Getenv("DOTENV_TEST_NEW"); got != "changed" {
+		t.Errorf("DOTENV_TEST_NEW = %q after the file changed, want changed", got)
+	}
+	load("")
+	if got, ok := os.LookupEnv("DOTENV_TEST_NEW"); ok {
+		t.Errorf("DOTENV_TEST_NEW = %q after the file was removed, want it unset", got)
+	}
+	if got := os.Getenv("DOTENV_TEST_SET"); got != "from-env" {
+		t.Errorf("DOTENV_TEST_SET = %q, want the environment's from-env", got)
+	}
+}
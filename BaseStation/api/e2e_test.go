@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"api/fakegemini"
+)
+
+func TestHealth(t *testing.T) {
+	h := newHarness(t)
+	if code := h.do(http.MethodGet, "/api/health", nil, nil); code != http.StatusOK {
+		t.Fatalf("health: status %d", code)
+	}
+}
+
+func TestSessionStartStop(t *testing.T) {
+	h := newHarness(t)
+	h.gemini.SetDefault(fakegemini.FocusReply(true, 0.9, false, "Writing notes."))
+
+	h.startSession()
+	st := h.stats()
+	if !st.SessionActive || st.Status != stateStudying {
+		t.Fatalf("after start: active=%v status=%q", st.SessionActive, st.Status)
+	}
+	if len(st.FocusHistory) != 1 || st.FocusHistory[0].FocusLevel != 0.9 {
+		t.Fatalf("focus history = %+v", st.FocusHistory)
+	}
+	if p := st.FocusHistory[0]; p.AudioStatus != audioOK || p.Decibels == nil || *p.Decibels != 48.5 {
+		t.Fatalf("audio not recorded: %+v", p)
+	}
+	if st.LastAnalysis.TextSummary != "Writing notes." || st.LastAnalysis.PromptID != defaultPromptID {
+		t.Fatalf("last analysis = %+v", st.LastAnalysis)
+	}
+
+	if code := h.do(http.MethodPost, "/api/session/stop", nil, nil); code != http.StatusOK {
+		t.Fatalf("session/stop: status %d", code)
+	}
+	if st := h.stats(); st.SessionActive || st.Status != stateIdle {
+		t.Fatalf("after stop: active=%v status=%q", st.SessionActive, st.Status)
+	}
+
+	var starts []time.Time
+	if code := h.do(http.MethodGet, "/api/sessionlist", nil, &starts); code != http.StatusOK || len(starts) != 1 {
+		t.Fatalf("sessionlist: status %d, %v", code, starts)
+	}
+	var s Session
+	path := "/api/dash/session?datetime=" + starts[0].Format(time.RFC3339Nano)
+	if code := h.do(http.MethodGet, path, nil, &s); code != http.StatusOK {
+		t.Fatalf("dash/session: status %d", code)
+	}
+	if s.SamplesCount != 1 || len(s.FocusHistory) != 1 || s.FocusHistory[0].SmoothedFocusLevel == nil {
+		t.Fatalf("stored session = %+v", s)
+	}
+	if len(s.Transitions) != 2 {
+		t.Fatalf("transitions = %+v", s.Transitions)
+	}
+}
+
+func TestCaptureOnceWait(t *testing.T) {
+	h := newHarness(t)
+	h.startSession()
+
+	h.gemini.Enqueue(fakegemini.FocusReply(false, 0.2, false, "Looking at a phone."))
+	var a Analysis
+	if code := h.do(http.MethodPost, "/api/capture/once?wait=true", nil, &a); code != http.StatusOK {
+		t.Fatalf("capture/once: status %d", code)
+	}
+	if a.IsFocused || a.FocusLevel != 0.2 {
+		t.Fatalf("analysis = %+v", a)
+	}
+	if st := h.stats(); st.SamplesCount != 2 || st.LastAnalysis.TextSummary != "Looking at a phone." {
+		t.Fatalf("samples=%d last=%+v", st.SamplesCount, st.LastAnalysis)
+	}
+	if _, err := os.Stat(filepath.Join(h.app.dataDir(), "latest.jpg")); err != nil {
+		t.Fatalf("latest.jpg: %v", err)
+	}
+}
+
+// The model only gets to set the core fields; bookkeeping it echoes back
+// (dedup provenance, flags, prompt ID) is ignored.
+func TestModelReplyCannotSetBookkeeping(t *testing.T) {
+	h := newHarness(t)
+	h.startSession()
+
+	h.gemini.Enqueue(fakegemini.Reply{Text: `{"is_focused": true, "focus_level": 0.9, "is_away": false,
+		"text_summary": "Writing.", "reused_from": "old.jpg", "hash_distance": 3,
+		"flags": ["made_up"], "prompt_id": "evil"}`})
+	var a Analysis
+	if code := h.do(http.MethodPost, "/api/capture/once?wait=true", nil, &a); code != http.StatusOK {
+		t.Fatalf("capture/once: status %d", code)
+	}
+	if a.ReusedFrom != "" || a.HashDistance != 0 || len(a.Flags) != 0 || a.PromptID != defaultPromptID {
+		t.Fatalf("analysis = %+v", a)
+	}
+	st := h.stats()
+	if p := st.FocusHistory[len(st.FocusHistory)-1]; p.Deduplicated {
+		t.Fatalf("focus point marked deduplicated: %+v", p)
+	}
+}
+
+func TestCaptureOnceJob(t *testing.T) {
+	h := newHarness(t)
+	h.startSession()
+
+	var sub struct {
+		JobID string `json:"job_id"`
+		URL   string `json:"url"`
+	}
+	if code := h.do(http.MethodPost, "/api/capture/once", nil, &sub); code != http.StatusAccepted || sub.JobID == "" {
+		t.Fatalf("capture/once: status %d, %+v", code, sub)
+	}
+	var job CaptureJob
+	h.waitFor("job to finish", func() bool {
+		h.do(http.MethodGet, sub.URL, nil, &job)
+		return job.Status != jobRunning
+	})
+	if job.Status != jobSucceeded || job.Analysis == nil {
+		t.Fatalf("job = %+v", job)
+	}
+	stages := map[string]bool{}
+	for _, s := range job.Stages {
+		stages[s.Name] = true
+	}
+	if !stages[stageImage] || !stages[stageAudio] || !stages[stageAnalysis] {
+		t.Fatalf("stages = %+v", job.Stages)
+	}
+	if code := h.do(http.MethodDelete, sub.URL, nil, nil); code != http.StatusConflict {
+		t.Fatalf("cancel finished job: status %d", code)
+	}
+	if code := h.do(http.MethodGet, "/api/capture/jobs/nope", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("unknown job: status %d", code)
+	}
+}
+
+func TestCaptureOnceModelErrors(t *testing.T) {
+	h := newHarness(t)
+	h.startSession()
+
+	// Upstream failure
+	h.gemini.Enqueue(fakegemini.Reply{Status: http.StatusInternalServerError, Error: "overloaded"})
+	if code := h.do(http.MethodPost, "/api/capture/once?wait=true", nil, nil); code != http.StatusBadGateway {
+		t.Fatalf("model 500: status %d", code)
+	}
+	// Malformed on every attempt (1 retry): rejected, not stored
+	h.gemini.Enqueue(fakegemini.Reply{Text: "not json"}, fakegemini.Reply{Text: `{"is_focused": true}`})
+	if code := h.do(http.MethodPost, "/api/capture/once?wait=true", nil, nil); code != http.StatusBadGateway {
+		t.Fatalf("malformed reply: status %d", code)
+	}
+	// Malformed once, then valid: retried and stored
+	h.gemini.Enqueue(fakegemini.Reply{Text: "```json\n{oops"}, fakegemini.FocusReply(true, 1.4, false, "Reading."))
+	var a Analysis
+	if code := h.do(http.MethodPost, "/api/capture/once?wait=true", nil, &a); code != http.StatusOK {
+		t.Fatalf("retried reply: status %d", code)
+	}
+	if a.FocusLevel != 1 || len(a.Flags) != 1 || a.Flags[0] != flagFocusClamped || a.Usage == nil || a.Usage.Calls != 2 {
+		t.Fatalf("analysis = %+v", a)
+	}
+	if st := h.stats(); st.SamplesCount != 2 {
+		t.Fatalf("samples = %d, want the first sample and the retried one", st.SamplesCount)
+	}
+}
+
+func TestPersistenceRoundTrip(t *testing.T) {
+	h := newHarness(t)
+	h.startSession()
+	if code := h.do(http.MethodPost, "/api/capture/once?wait=true", nil, nil); code != http.StatusOK {
+		t.Fatalf("capture/once: status %d", code)
+	}
+	before := h.stats()
+	<-h.app.stopScheduler()
+	if err := h.app.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(h.app.statePath()); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0o644 {
+		t.Fatalf("state file mode %v, want 0644", fi.Mode().Perm())
+	}
+
+	app := h.restart()
+	if err := app.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	after := h.stats()
+	if !after.SessionActive || after.SessionStarted != before.SessionStarted || after.SamplesCount != before.SamplesCount {
+		t.Fatalf("restored %+v, saved %+v", after, before)
+	}
+	if len(after.FocusHistory) != len(before.FocusHistory) || after.LastAnalysis.TextSummary != before.LastAnalysis.TextSummary {
+		t.Fatalf("history/analysis not restored: %+v", after)
+	}
+}
+
+func TestPersistenceReplaysWAL(t *testing.T) {
+	h := newHarness(t)
+	h.startSession()
+	<-h.app.stopScheduler()
+	// A sample recorded after the last snapshot lives only in the WAL
+	res, err := h.app.takeSample(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.app.recordSample(res) {
+		t.Fatal("sample not recorded")
+	}
+
+	app := h.restart()
+	if err := app.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if st := h.stats(); st.SamplesCount != 2 {
+		t.Fatalf("samples = %d after replay, want 2", st.SamplesCount)
+	}
+}
+
+func TestRestartRecovery(t *testing.T) {
+	h := newHarness(t)
+	h.startSession()
+	<-h.app.stopScheduler()
+	if err := h.app.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// With a 5m interval, 10 minutes is just the wait for the next tick
+	t.Setenv("SAMPLE_INTERVAL", "5m")
+	app := h.restart()
+	if err := app.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := app.recoverActiveSession(time.Now().Add(10 * time.Minute)); err != nil || !active {
+		t.Fatalf("recover: active=%v err=%v", active, err)
+	}
+	app.mu.RLock()
+	n := len(app.downtime)
+	app.mu.RUnlock()
+	if n != 0 {
+		t.Fatalf("downtime intervals = %d with a 5m interval, want 0", n)
+	}
+	t.Setenv("SAMPLE_INTERVAL", "")
+
+	// Back up shortly after an outage: the gap becomes downtime
+	app = h.restart()
+	if err := app.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	active, err := app.recoverActiveSession(time.Now().Add(10 * time.Minute))
+	if err != nil || !active {
+		t.Fatalf("recover: active=%v err=%v", active, err)
+	}
+	app.mu.Lock()
+	n = len(app.downtime)
+	app.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("downtime intervals = %d, want 1", n)
+	}
+
+	// Back up much later: the session is closed at its last sample
+	t.Setenv("SESSION_IDLE_CLOSE_AFTER", "1h")
+	app = h.restart()
+	if err := app.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	active, err = app.recoverActiveSession(time.Now().Add(3 * time.Hour))
+	if err != nil || active {
+		t.Fatalf("recover after idle: active=%v err=%v", active, err)
+	}
+	if err := app.loadAllSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if len(app.sessions) != 1 || app.sessions[0].ClosedReason == "" {
+		t.Fatalf("sessions = %+v", app.sessions)
+	}
+}
+
+// A pause open across an outage must not overlap the recorded downtime.
+func TestRestartRecoveryWhilePaused(t *testing.T) {
+	h := newHarness(t)
+	h.startSession()
+	<-h.app.stopScheduler()
+	app := h.app
+	app.mu.Lock()
+	last := app.lastActivityLocked()
+	app.sessionPaused, app.pausedSince = true, last.Add(-10*time.Minute)
+	app.mu.Unlock()
+
+	now := last.Add(time.Hour)
+	if active, err := app.recoverActiveSession(now); err != nil || !active {
+		t.Fatalf("recover: active=%v err=%v", active, err)
+	}
+	app.mu.RLock()
+	open := app.pausedSince
+	app.mu.RUnlock()
+	if !open.Equal(now) {
+		t.Errorf("pause reopened at %s, want %s", open, now)
+	}
+	s, err := app.endSession(now.Add(time.Minute), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := s.End
+	off, away := downtimeTotal(s.Downtime, end), downtimeTotal(s.Pauses, end)
+	if off != time.Hour || away != 11*time.Minute {
+		t.Errorf("downtime %s, paused %s, want 1h0m0s and 11m0s", off, away)
+	}
+}
+
+// A session started while standby sampling runs gets its first sample right
+// away, not at the next standby tick.
+func TestSessionStartInStandby(t *testing.T) {
+	h := newHarness(t)
+	h.gemini.SetDefault(fakegemini.FocusReply(false, 0, true, "Nobody here."))
+	h.configure(func(c *Config) {
+		c.Presence.Standby = true
+		c.Presence.StandbyInterval = time.Hour
+	})
+	h.app.enterStandby(h.e, false)
+	h.waitFor("standby sample", func() bool { return len(h.gemini.Requests()) == 1 })
+	h.startSession()
+}
+
+func TestDashboardEndpoints(t *testing.T) {
+	h := newHarness(t)
+	st := h.stats()
+	if st.SessionActive || st.SamplesCount != 0 || st.Status != stateIdle {
+		t.Fatalf("fresh stats = %+v", st)
+	}
+	var prompt struct {
+		Template PromptTemplate `json:"template"`
+		Text     string         `json:"text"`
+	}
+	if code := h.do(http.MethodGet, "/api/prompt", nil, &prompt); code != http.StatusOK || prompt.Template.ID != defaultPromptID {
+		t.Fatalf("prompt: status %d, %+v", code, prompt.Template)
+	}
+	var usage map[string]any
+	if code := h.do(http.MethodGet, "/api/usage", nil, &usage); code != http.StatusOK || usage["budget"] == nil {
+		t.Fatalf("usage: status %d, %v", code, usage)
+	}
+	if code := h.do(http.MethodGet, "/api/audio/levels", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("audio levels without monitor: status %d", code)
+	}
+
+	h.startSession()
+	if got := len(h.gemini.Requests()); got != 1 {
+		t.Fatalf("model calls = %d, want 1", got)
+	}
+	if st := h.stats(); st.Usage.Calls != 1 || st.UsageToday.TotalTokens == 0 || st.LastImageURL != "/images/latest.jpg" {
+		t.Fatalf("stats after a sample = %+v", st)
+	}
+}
+
+// stubCapturer and stubAnalyzer stand in for the python scripts and Gemini.
+type stubCapturer struct{ frame string }
+
+func (c stubCapturer) CaptureImage(context.Context, time.Time) (string, error) { return c.frame, nil }
+
+func (c stubCapturer) CaptureAudio(context.Context, time.Time) (AudioSummary, error) {
+	return AudioSummary{AvgDB: 40}, nil
+}
+
+type stubAnalyzer struct{ reply fakegemini.Reply }
+
+func (a stubAnalyzer) GenerateContent(context.Context, []byte) (string, usageMetadata, error) {
+	return a.reply.Text, usageMetadata{PromptTokenCount: 10, TotalTokenCount: 10}, nil
+}
+
+func TestIndependentApps(t *testing.T) {
+	frame := filepath.Join(t.TempDir(), "frame.jpg")
+	writeFrame(t, frame, 0)
+	newApp := func(summary string) *App {
+		app := NewApp(DefaultConfig(t.TempDir()))
+		app.Capturer = stubCapturer{frame: frame}
+		app.Analyzer = stubAnalyzer{reply: fakegemini.FocusReply(true, 0.7, false, summary)}
+		t.Cleanup(app.Close)
+		return app
+	}
+	a, b := newApp("Station A."), newApp("Station B.")
+
+	if err := a.beginSession(time.Now(), "", false); err != nil {
+		t.Fatal(err)
+	}
+	res, err := a.takeSample(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.recordSample(res)
+	if _, err := b.takeSample(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	sa, sb := a.snapshot(), b.snapshot()
+	if !sa.SessionActive || sa.SamplesCount != 1 || sa.LastAnalysis.TextSummary != "Station A." {
+		t.Fatalf("station A = %+v", sa)
+	}
+	if sb.SessionActive || sb.SamplesCount != 0 || sb.UsageToday.Calls != 1 {
+		t.Fatalf("station B = %+v", sb)
+	}
+	if _, err := os.Stat(b.statePath()); !os.IsNotExist(err) {
+		t.Fatalf("station B wrote state: %v", err)
+	}
+}
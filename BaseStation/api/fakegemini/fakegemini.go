@@ -0,0 +1,214 @@
+// Package fakegemini is a stand-in for the Gemini generateContent endpoint,
+// for tests and offline demos. Replies are scripted: each request takes the
+// next queued Reply, or the default once the queue is empty. A Reply can
+// delay, fail with an HTTP status, return no candidates or return arbitrary
+// (including malformed) text.
+//
+// Point the base station at it with GEMINI_BASE_URL=<server URL>.
+package fakegemini
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reply is one scripted response.
+type Reply struct {
+	Text         string `json:"text,omitempty"`          // candidate text
+	Status       int    `json:"status,omitempty"`        // HTTP status, 200 if zero
+	Error        string `json:"error,omitempty"`         // message for an error status
+	DelayMs      int    `json:"delay_ms,omitempty"`      // wait before answering
+	NoCandidates bool   `json:"no_candidates,omitempty"` // answer 200 with no candidates
+	Usage        Usage  `json:"usage,omitzero"`
+}
+
+// Usage is reported as usageMetadata.
+type Usage struct {
+	PromptTokens    int `json:"prompt_tokens"`
+	CandidateTokens int `json:"candidate_tokens"`
+	ThoughtTokens   int `json:"thought_tokens"`
+}
+
+// Request is what the server saw for one call.
+type Request struct {
+	Model  string
+	Key    string
+	Images int    // inline_data parts
+	Text   string // text parts joined by newlines
+	Body   map[string]any
+}
+
+// FocusReply is a well-formed analysis reply.
+func FocusReply(focused bool, level float64, away bool, summary string) Reply {
+	b, _ := json.Marshal(map[string]any{
+		"is_focused":   focused,
+		"focus_level":  level,
+		"is_away":      away,
+		"text_summary": summary,
+	})
+	return Reply{Text: string(b), Usage: Usage{PromptTokens: 1290, CandidateTokens: 40}}
+}
+
+// Server implements http.Handler; wrap it in httptest.NewServer or
+// http.ListenAndServe.
+type Server struct {
+	mu       sync.Mutex
+	queue    []Reply
+	def      Reply
+	loop     bool
+	requests []Request
+}
+
+// New returns a server whose default reply is a focused student.
+func New() *Server {
+	return &Server{def: FocusReply(true, 0.8, false, "Student reading at the desk.")}
+}
+
+// Enqueue adds replies to the script.
+func (s *Server) Enqueue(r ...Reply) {
+	s.mu.Lock()
+	s.queue = append(s.queue, r...)
+	s.mu.Unlock()
+}
+
+// SetDefault sets the reply used when the script is empty.
+func (s *Server) SetDefault(r Reply) {
+	s.mu.Lock()
+	s.def = r
+	s.mu.Unlock()
+}
+
+// SetLoop makes the script repeat instead of running out.
+func (s *Server) SetLoop(loop bool) {
+	s.mu.Lock()
+	s.loop = loop
+	s.mu.Unlock()
+}
+
+// Requests returns the calls received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) next() Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return s.def
+	}
+	r := s.queue[0]
+	s.queue = s.queue[1:]
+	if s.loop {
+		s.queue = append(s.queue, r)
+	}
+	return r
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Control endpoint: POST /_fake/replies with a JSON array of Reply
+	if r.URL.Path == "/_fake/replies" && r.Method == http.MethodPost {
+		var rs []Reply
+		if err := json.NewDecoder(r.Body).Decode(&rs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Enqueue(rs...)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v1beta/models/")
+	model, ok2 := strings.CutSuffix(rest, ":generateContent")
+	if !ok || !ok2 || r.Method != http.MethodPost {
+		writeError(w, http.StatusNotFound, "unknown endpoint "+r.Method+" "+r.URL.Path)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	req := Request{Model: model, Key: r.URL.Query().Get("key")}
+	if req.Key == "" {
+		req.Key = r.Header.Get("x-goog-api-key")
+	}
+	if err := json.Unmarshal(body, &req.Body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON payload: "+err.Error())
+		return
+	}
+	req.Images, req.Text = summarize(req.Body)
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+
+	reply := s.next()
+	if reply.DelayMs > 0 {
+		select {
+		case <-time.After(time.Duration(reply.DelayMs) * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if reply.Status != 0 && reply.Status != http.StatusOK {
+		writeError(w, reply.Status, reply.Error)
+		return
+	}
+
+	resp := map[string]any{
+		"usageMetadata": map[string]any{
+			"promptTokenCount":     reply.Usage.PromptTokens,
+			"candidatesTokenCount": reply.Usage.CandidateTokens,
+			"thoughtsTokenCount":   reply.Usage.ThoughtTokens,
+			"totalTokenCount":      reply.Usage.PromptTokens + reply.Usage.CandidateTokens + reply.Usage.ThoughtTokens,
+		},
+		"modelVersion": model,
+	}
+	if !reply.NoCandidates {
+		resp["candidates"] = []any{map[string]any{
+			"content": map[string]any{
+				"role":  "model",
+				"parts": []any{map[string]any{"text": reply.Text}},
+			},
+			"finishReason": "STOP",
+		}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// summarize counts image parts and collects the text parts of a request.
+func summarize(body map[string]any) (images int, text string) {
+	var texts []string
+	contents, _ := body["contents"].([]any)
+	for _, c := range contents {
+		cm, _ := c.(map[string]any)
+		parts, _ := cm["parts"].([]any)
+		for _, p := range parts {
+			pm, _ := p.(map[string]any)
+			if _, ok := pm["inline_data"]; ok {
+				images++
+			}
+			if t, ok := pm["text"].(string); ok {
+				texts = append(texts, t)
+			}
+		}
+	}
+	return images, strings.Join(texts, "\n")
+}
+
+// writeError answers in the shape of a Google API error.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	if msg == "" {
+		msg = fmt.Sprintf("fake error %d", status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{
+		"code":    status,
+		"message": msg,
+		"status":  http.StatusText(status),
+	}})
+}
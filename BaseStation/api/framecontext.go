@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// ----- Multi-frame analysis and focus smoothing -----
+//
+// A single frame can't tell a glance at the phone from a distracted student.
+// With analysis.context_frames = N the last N recorded samples of the session
+// (no older than analysis.context_max_age) go along with the current frame:
+// analysis.context_mode = "summaries" (default) sends their verdicts as text,
+// "frames" sends the earlier images too.
+//
+// Independently, focus levels are smoothed server-side with a time-aware
+// exponential moving average (analysis.smoothing_window, default 3m) and served
+// as smoothed_focus_level next to the raw value.
+
+const (
+	contextModeSummaries = "summaries"
+	contextModeFrames    = "frames"
+
+	maxContextFrames          = 8
+	defaultContextMaxAge      = 10 * time.Minute
+	defaultSmoothingWindow    = 3 * time.Minute
+	contextFramesInstructions = "The earlier samples are context only: judge the current frame, but use them to tell a brief glance away from a sustained change in focus."
+)
+
+// contextFrame is a recorded sample kept for the next analyses.
+type contextFrame struct {
+	At        time.Time
+	ImageFile string
+	Analysis  Analysis
+}
+
+// rememberFrameLocked keeps a recorded sample for later context. Caller must
+// hold mu.
+func (app *App) rememberFrameLocked(res sampleResult) {
+	app.recentFrames = append(app.recentFrames, contextFrame{At: res.TakenAt, ImageFile: res.ImageFile, Analysis: res.Analysis})
+	if len(app.recentFrames) > maxContextFrames {
+		app.recentFrames = app.recentFrames[len(app.recentFrames)-maxContextFrames:]
+	}
+}
+
+// contextFrames returns up to n recent frames taken before at and no older
+// than maxAge.
+func (app *App) contextFrames(n int, maxAge time.Duration, at time.Time) []contextFrame {
+	if n == 0 {
+		return nil
+	}
+	oldest := at.Add(-maxAge)
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	var out []contextFrame
+	for _, f := range app.recentFrames {
+		if f.At.Before(at) && !f.At.Before(oldest) {
+			out = append(out, f)
+		}
+	}
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+func (f contextFrame) describe() string {
+	a := f.Analysis
+	return fmt.Sprintf("%s: is_focused=%t focus_level=%.2f is_away=%t: %s",
+		f.At.Format(time.TimeOnly), a.IsFocused, a.FocusLevel, a.IsAway, a.TextSummary)
+}
+
+// analysisParts builds the request parts: earlier samples (if any), then the
+// current frame and the prompt. It returns how many earlier samples made it.
+func analysisParts(frames []contextFrame, mode string, current []byte, prompt string) ([]any, int) {
+	image := func(b []byte) any {
+		return map[string]any{"inline_data": map[string]any{
+			"mime_type": "image/jpeg",
+			"data":      base64.StdEncoding.EncodeToString(b),
+		}}
+	}
+	text := func(s string) any { return map[string]any{"text": s} }
+
+	var parts []any
+	used := 0
+	switch mode {
+	case contextModeFrames:
+		for _, f := range frames {
+			b, err := os.ReadFile(f.ImageFile)
+			if err != nil {
+				continue // pruned or moved; skip it
+			}
+			parts = append(parts, text("Earlier frame, "+f.describe()), image(b))
+			used++
+		}
+	default:
+		if len(frames) > 0 {
+			lines := []string{"Earlier samples this session, oldest first:"}
+			for _, f := range frames {
+				lines = append(lines, "- "+f.describe())
+			}
+			parts = append(parts, text(strings.Join(lines, "\n")))
+			used = len(frames)
+		}
+	}
+	if used > 0 {
+		parts = append(parts, text("Current frame:"))
+		prompt += "\n" + contextFramesInstructions
+	}
+	return append(parts, image(current), text(prompt)), used
+}
+
+// smoothFocus returns a copy of points with SmoothedFocusLevel filled in. The
+// EMA weight of each sample grows with the time since the previous one, so
+// out-of-band samples don't count more than scheduled ones. Away samples
+// carry the previous value. A zero window leaves the levels unsmoothed.
+func smoothFocus(points []FocusPoint, window time.Duration) []FocusPoint {
+	tau := window.Seconds()
+	out := append([]FocusPoint(nil), points...)
+	var have bool
+	var ema float64
+	var last time.Time
+	for i := range out {
+		p := &out[i]
+		at, err := time.Parse(time.RFC3339, p.Timestamp)
+		if !p.IsAway {
+			switch {
+			case !have || err != nil || tau <= 0:
+				ema = p.FocusLevel
+			default:
+				dt := max(at.Sub(last).Seconds(), 0)
+				w := 1 - math.Exp(-dt/tau)
+				ema += w * (p.FocusLevel - ema)
+			}
+			have = true
+			if err == nil {
+				last = at
+			}
+		}
+		if have {
+			v := ema
+			p.SmoothedFocusLevel = &v
+		}
+	}
+	return out
+}
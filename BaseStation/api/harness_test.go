@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"api/fakegemini"
+
+	"github.com/labstack/echo/v4"
+)
+
+// harness runs the base station against a temp repoRoot with fake capture
+// scripts and a fake Gemini server.
+type harness struct {
+	t      *testing.T
+	root   string
+	app    *App
+	e      *echo.Echo
+	srv    *httptest.Server
+	gemini *fakegemini.Server
+}
+
+// Fake wili/wileye.py: copies the frame at $FAKE_FRAME to --dest.
+const fakeEyeScript = `import os, shutil, sys
+dest = sys.argv[sys.argv.index("--dest") + 1]
+shutil.copy(os.environ["FAKE_FRAME"], dest)
+print("Image saved to: " + dest, flush=True)
+`
+
+// Fake wili/audio.py: writes a fixed summary to --dest.
+const fakeAudioScript = `import sys
+dest = sys.argv[sys.argv.index("--dest") + 1]
+with open(dest, "w") as f:
+    f.write('{"avg_db": 48.5, "peak_db": 60.0, "speech_likelihood": 0.1, "bands": {"low": 0.2, "speech": 0.5, "high": 0.3}}')
+print("Audio saved to: " + dest, flush=True)
+`
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available for the fake capture scripts")
+	}
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, wiliEyeScriptRel), fakeEyeScript)
+	writeFile(t, filepath.Join(root, wiliAudioScriptRel), fakeAudioScript)
+	writeFile(t, filepath.Join(root, staticDirRel, "index.html"), "<html></html>")
+	frame := filepath.Join(root, "frame.jpg")
+	writeFrame(t, frame, 0)
+	gemini := fakegemini.New()
+	gsrv := httptest.NewServer(gemini)
+	t.Cleanup(gsrv.Close)
+
+	// Nothing from the developer's environment: every config key's variable
+	// and the ones read outside the config
+	defaults := DefaultConfig("")
+	for _, f := range defaults.fields() {
+		t.Setenv(f.env, "")
+	}
+	for _, k := range []string{"GEMINI_API_KEY", "GOOGLE_API_KEY", "BASESTATION_CONFIG", "BASESTATION_ROOT"} {
+		t.Setenv(k, "")
+	}
+	t.Setenv("GEMINI_BASE_URL", gsrv.URL)
+	t.Setenv("FAKE_FRAME", frame)
+	t.Setenv("FRAME_DEDUP_DISTANCE", "0")
+	t.Setenv("ANALYSIS_RETRIES", "1")
+
+	h := &harness{t: t, root: root, gemini: gemini}
+	h.serve(h.newApp())
+	t.Cleanup(func() {
+		h.app.Close()
+		h.srv.Close()
+	})
+	return h
+}
+
+// newApp builds a station from the harness root and environment, like main.
+func (h *harness) newApp() *App {
+	h.t.Helper()
+	cfg, err := loadConfig(h.root, nil)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return NewApp(cfg)
+}
+
+// configure changes the running station's config in place, as a reload
+// would.
+func (h *harness) configure(fn func(*Config)) {
+	h.app.cfgMu.Lock()
+	fn(&h.app.cfg)
+	h.app.cfgMu.Unlock()
+}
+
+// serve puts app behind the harness's HTTP server, replacing the previous one.
+func (h *harness) serve(app *App) {
+	h.t.Helper()
+	if err := app.ensureDirs(); err != nil {
+		h.t.Fatal(err)
+	}
+	e := echo.New()
+	e.HideBanner = true
+	RegisterRoutes(e, app)
+	h.app, h.e, h.srv = app, e, httptest.NewServer(e)
+}
+
+// restart stops the running station like a crash would (no final save) and
+// serves a fresh one on the same root, without loading anything yet.
+func (h *harness) restart() *App {
+	h.t.Helper()
+	h.app.Close()
+	h.srv.Close()
+	h.serve(h.newApp())
+	return h.app
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeFrame writes a test JPEG; different shifts give different dHashes.
+func writeFrame(t *testing.T, path string, shift int) {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 160, 120))
+	for y := 0; y < 120; y++ {
+		for x := 0; x < 160; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8((x + shift) * 255 / 160)})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, buf.String())
+}
+
+// do sends a request and decodes a JSON response into out (if non-nil).
+func (h *harness) do(method, path string, body any, out any) int {
+	h.t.Helper()
+	var rd io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, h.srv.URL+path, rd)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if out != nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(b, out); err != nil {
+			h.t.Fatalf("%s %s: decode %q: %v", method, path, b, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func (h *harness) stats() StudyStats {
+	h.t.Helper()
+	var st StudyStats
+	if code := h.do(http.MethodGet, "/api/dash/monolithic", nil, &st); code != http.StatusOK {
+		h.t.Fatalf("monolithic: status %d", code)
+	}
+	return st
+}
+
+// waitFor polls cond until it holds or the deadline passes.
+func (h *harness) waitFor(what string, cond func() bool) {
+	h.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// startSession starts a session over HTTP and waits for the scheduler's
+// immediate first sample.
+func (h *harness) startSession() {
+	h.t.Helper()
+	if code := h.do(http.MethodPost, "/api/session/start", nil, nil); code != http.StatusOK {
+		h.t.Fatalf("session/start: status %d", code)
+	}
+	h.waitFor("first sample", func() bool { return h.stats().SamplesCount == 1 })
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ----- Asynchronous capture jobs -----
+//
+// POST /api/capture/once hands back a job ID straight away; the capture runs
+// through the coordinator in the background and the job can be polled with
+// GET /api/capture/jobs/:id or cancelled with DELETE. Cancelling a job leaves
+// the capture; if nobody else (e.g. the scheduler) shares it, the capture is
+// aborted.
+
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+
+	// Finished jobs are forgotten after this long by default
+	// (retention.jobs).
+	jobRetention = time.Hour
+)
+
+var errJobFinished = errors.New("job already finished")
+
+// CaptureJob is the public view of a capture job.
+type CaptureJob struct {
+	ID         string        `json:"id"`
+	Status     string        `json:"status"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt time.Time     `json:"finished_at,omitzero"`
+	Shared     bool          `json:"shared"` // joined a capture already in flight
+	Stages     []StageTiming `json:"stages"`
+	Analysis   *Analysis     `json:"analysis,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+type captureJob struct {
+	CaptureJob
+	call   *captureCall
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type jobStore struct {
+	app  *App
+	mu   sync.Mutex
+	jobs map[string]*captureJob
+}
+
+func newJobID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// submit starts (or joins) a capture and tracks it as a job.
+func (s *jobStore) submit() CaptureJob {
+	call, joined := s.app.startSample()
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &captureJob{
+		CaptureJob: CaptureJob{ID: newJobID(), Status: jobRunning, CreatedAt: time.Now(), Shared: joined},
+		call:       call,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	s.mu.Lock()
+	s.pruneLocked(time.Now())
+	s.jobs[j.ID] = j
+	view := s.viewLocked(j)
+	s.mu.Unlock()
+	go s.run(j)
+	return view
+}
+
+func (s *jobStore) run(j *captureJob) {
+	defer j.cancel()
+	res, err := j.call.Wait(j.ctx)
+	if j.ctx.Err() != nil {
+		return
+	}
+	recorded := err == nil && s.app.recordSample(res)
+
+	s.mu.Lock()
+	if j.Status == jobRunning {
+		j.FinishedAt = time.Now()
+		if err != nil {
+			j.Status = jobFailed
+			j.Error = err.Error()
+		} else {
+			j.Status = jobSucceeded
+			a := res.Analysis
+			j.Analysis = &a
+		}
+	}
+	s.mu.Unlock()
+
+	if recorded {
+		if err := s.app.saveState(); err != nil {
+			klog.Errorf("saveState failed: %v", err)
+		}
+	}
+}
+
+func (s *jobStore) get(id string) (CaptureJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return CaptureJob{}, false
+	}
+	return s.viewLocked(j), true
+}
+
+// cancelJob marks a running job cancelled. It returns errJobFinished if the
+// job already completed.
+func (s *jobStore) cancelJob(id string) (CaptureJob, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return CaptureJob{}, false, nil
+	}
+	if j.Status != jobRunning {
+		return s.viewLocked(j), true, errJobFinished
+	}
+	j.Status = jobCanceled
+	j.FinishedAt = time.Now()
+	j.cancel()
+	return s.viewLocked(j), true, nil
+}
+
+// viewLocked copies the job with live stage timings. Caller must hold s.mu.
+func (s *jobStore) viewLocked(j *captureJob) CaptureJob {
+	v := j.CaptureJob
+	v.Stages = j.call.Stages()
+	return v
+}
+
+func (s *jobStore) pruneLocked(now time.Time) {
+	keep := s.app.config().Retention.Jobs
+	for id, j := range s.jobs {
+		if j.Status != jobRunning && now.Sub(j.FinishedAt) > keep {
+			delete(s.jobs, id)
+		}
+	}
+}
@@ -3,17 +3,20 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/base64"
-	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
-	"strconv"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
@@ -29,66 +32,103 @@ type Analysis struct {
 	FocusLevel  float64 `json:"focus_level"`
 	IsAway      bool    `json:"is_away"`
 	TextSummary string  `json:"text_summary"`
+	// Corrections made while validating the model's reply (analysis.go)
+	Flags []string `json:"flags,omitempty"`
+	// Template that produced this analysis and its extra fields (prompt.go)
+	PromptID string         `json:"prompt_id,omitempty"`
+	Extra    map[string]any `json:"extra,omitempty"`
+	// Earlier samples sent along as context (framecontext.go)
+	ContextFrames int `json:"context_frames,omitempty"`
+	// Tokens, cost and latency of the model calls (usage.go)
+	Usage *AnalysisUsage `json:"usage,omitempty"`
+	// Set when copied from a near-identical earlier frame (dedup.go)
+	ReusedFrom   string `json:"reused_from,omitempty"`
+	HashDistance int    `json:"hash_distance,omitempty"`
 }
 
 type FocusPoint struct {
-	Timestamp  string  `json:"timestamp"`
-	Decibels   float64 `json:"decibels"`
-	FocusLevel float64 `json:"focus_level"`
-	IsFocused  bool    `json:"is_focused"`
-	IsAway     bool    `json:"is_away"`
+	Timestamp    string         `json:"timestamp"`
+	Decibels     *float64       `json:"decibels"` // nil when no fresh audio was captured
+	AudioStatus  string         `json:"audio_status"`
+	Audio        *AudioSummary  `json:"audio,omitempty"`
+	FocusLevel   float64        `json:"focus_level"`
+	IsFocused    bool           `json:"is_focused"`
+	IsAway       bool           `json:"is_away"`
+	Trigger      string         `json:"trigger,omitempty"`      // set on out-of-band samples (triggers.go)
+	Extra        map[string]any `json:"extra,omitempty"`        // the prompt's extra fields
+	Deduplicated bool           `json:"deduplicated,omitempty"` // analysis reused from a near-identical frame
+	// Derived when served (smoothFocus), not stored
+	SmoothedFocusLevel *float64 `json:"smoothed_focus_level,omitempty"`
 }
 
+// FocusPoint.AudioStatus values
+const (
+	audioOK         = "ok"
+	audioFailed     = "failed"
+	audioUnverified = "unverified" // recorded before audio failures were tracked
+)
+
 type StudyStats struct {
-	Status          string       `json:"status"`
-	Timestamp       string       `json:"timestamp"`
-	SessionActive   bool         `json:"session_active"`
-	SessionStarted  string       `json:"session_started,omitempty"`
-	DurationSeconds int64        `json:"duration_seconds"`
-	SamplesCount    int          `json:"samples_count"`
-	LastImageURL    string       `json:"last_image_url"`
-	LastAnalysis    Analysis     `json:"last_analysis"`
-	FocusHistory    []FocusPoint `json:"focus_history"`
+	Status          string             `json:"status"`
+	Timestamp       string             `json:"timestamp"`
+	SessionActive   bool               `json:"session_active"`
+	SessionStarted  string             `json:"session_started,omitempty"`
+	DurationSeconds int64              `json:"duration_seconds"`
+	SamplesCount    int                `json:"samples_count"`
+	LastImageURL    string             `json:"last_image_url"`
+	LastAnalysis    Analysis           `json:"last_analysis"`
+	FocusHistory    []FocusPoint       `json:"focus_history"`
+	Audio           AudioStats         `json:"audio"`
+	DowntimeSeconds int64              `json:"downtime_seconds,omitempty"`
+	PausedSeconds   int64              `json:"paused_seconds,omitempty"`
+	Transitions     []Transition       `json:"transitions,omitempty"`
+	NoiseEvents     []NoiseEvent       `json:"noise_events,omitempty"`
+	Distractions    []DistractionEvent `json:"distractions,omitempty"`
+	Usage           AnalysisUsage      `json:"usage"`
+	UsageToday      AnalysisUsage      `json:"usage_today"`
+	Budget          BudgetStatus       `json:"budget"`
+	AudioLevels     []LevelPoint       `json:"audio_levels,omitempty"` // last few minutes, when audio.monitor is on
 }
 
 // PersistedState represents the on-disk snapshot of the in-memory state
+// (see schema.go before changing fields)
 type PersistedState struct {
-	SessionActive    bool
-	SessionStart     time.Time
-	LastImageFile    string
-	LastAnalysis     Analysis
-	SamplesCount     int
-	FocusHistory     []FocusPoint
-	CurrentSessionID string
+	SessionActive    bool                     `json:"session_active"`
+	SessionStart     time.Time                `json:"session_start"`
+	LastImageFile    string                   `json:"last_image_file"`
+	LastAnalysis     Analysis                 `json:"last_analysis"`
+	SamplesCount     int                      `json:"samples_count"`
+	FocusHistory     []FocusPoint             `json:"focus_history"`
+	CurrentSessionID string                   `json:"current_session_id"`
+	Downtime         []Interval               `json:"downtime,omitempty"`
+	SessionPaused    bool                     `json:"session_paused,omitempty"`
+	PausedSince      time.Time                `json:"paused_since,omitzero"`
+	Pauses           []Interval               `json:"pauses,omitempty"`
+	Transitions      []Transition             `json:"transitions,omitempty"`
+	NoiseEvents      []NoiseEvent             `json:"noise_events,omitempty"`
+	Distractions     []DistractionEvent       `json:"distractions,omitempty"`
+	SessionUsage     AnalysisUsage            `json:"session_usage,omitzero"`
+	DailyUsage       map[string]AnalysisUsage `json:"daily_usage,omitempty"`
 }
 
 // Session represents a completed study session
 type Session struct {
-	ID           string       `json:"status"`
-	Start        time.Time    `json:"timestamp"`
-	End          time.Time    `json:"end"`
-	SamplesCount int          `json:"samples_count"`
-	FocusHistory []FocusPoint `json:"focus_history"`
-	LastAnalysis Analysis     `json:"last_analysis"`
-}
-
-// ----- Global state (simple in-memory for hackathon) -----
-
-var (
-	mu               sync.Mutex
-	sessionActive    bool
-	sessionStart     time.Time
-	lastImageFile    string
-	lastAnalysis     Analysis
-	samplesCount     int
-	focusHistory     []FocusPoint
-	tickerStopChan   chan struct{}
-	repoRoot         string
-	currentSessionID string
-	sessions         []Session
-)
+	ID           string             `json:"status"`
+	Start        time.Time          `json:"timestamp"`
+	End          time.Time          `json:"end"`
+	SamplesCount int                `json:"samples_count"`
+	FocusHistory []FocusPoint       `json:"focus_history"`
+	LastAnalysis Analysis           `json:"last_analysis"`
+	Downtime     []Interval         `json:"downtime,omitempty"`
+	Pauses       []Interval         `json:"pauses,omitempty"`
+	Transitions  []Transition       `json:"transitions,omitempty"`
+	NoiseEvents  []NoiseEvent       `json:"noise_events,omitempty"`
+	Distractions []DistractionEvent `json:"distractions,omitempty"`
+	Usage        AnalysisUsage      `json:"usage,omitzero"`
+	ClosedReason string             `json:"closed_reason,omitempty"`
+}
 
-// ----- Path constants (relative to repo root) -----
+// ----- Path defaults (relative to repo root, see config.go) -----
 const (
 	wiliEyeScriptRel   = "wili/wileye.py"
 	wiliAudioScriptRel = "wili/audio.py"
@@ -101,181 +141,263 @@ const (
 
 // ----- Helpers -----
 
-func dataDir() string {
-	// Place images under <repoRoot>/BaseStation/api/data/images
-	if repoRoot != "" {
-		return filepath.Join(repoRoot, dataImagesRel)
-	}
-	// Fallback: relative (works when CWD is repo root)
-	return filepath.Join(dataImagesRel)
+func (app *App) dataDir() string {
+	cfg := app.config()
+	return cfg.path(cfg.Paths.Images)
 }
 
-func ensureDirs() error {
-	if err := os.MkdirAll(dataDir(), 0o755); err != nil {
+func (app *App) ensureDirs() error {
+	if err := os.MkdirAll(app.dataDir(), 0o755); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(sessionsDir(), 0o755); err != nil {
+	if err := os.MkdirAll(app.sessionsDir(), 0o755); err != nil {
 		return err
 	}
 	return nil
 }
 
-func wiliEyePath() string {
-	// Path to the wileye script from repo root execution
-	if repoRoot != "" {
-		return filepath.Join(repoRoot, wiliEyeScriptRel)
-	}
-	return filepath.Join(wiliEyeScriptRel)
-}
-
-func wiliAudioPath() string {
-	// Path to the wileye script from repo root execution
-	if repoRoot != "" {
-		return filepath.Join(repoRoot, wiliAudioScriptRel)
-	}
-	return filepath.Join(wiliAudioScriptRel)
+func (app *App) wiliAudioPath() string {
+	cfg := app.config()
+	return cfg.path(cfg.Paths.AudioScript)
 }
 
-// sessionsDir returns the absolute path to the sessions directory
-func sessionsDir() string {
-	if repoRoot != "" {
-		return filepath.Join(repoRoot, sessionsDirRel)
-	}
-	return sessionsDirRel
+// sessionsDir returns the path to the sessions directory
+func (app *App) sessionsDir() string {
+	cfg := app.config()
+	return cfg.path(cfg.Paths.Sessions)
 }
 
-func statePath() string { return filepath.Join(sessionsDir(), stateFileName) }
+func (app *App) statePath() string { return filepath.Join(app.sessionsDir(), stateFileName) }
 
-func saveState() error {
+// saveState writes a snapshot of the session state. Saves are serialized so
+// an older snapshot can never replace a newer one.
+func (app *App) saveState() error {
+	app.saveMu.Lock()
+	defer app.saveMu.Unlock()
 	st := PersistedState{}
-	mu.Lock()
-	st.SessionActive = sessionActive
-	st.SessionStart = sessionStart
-	st.LastImageFile = lastImageFile
-	st.LastAnalysis = lastAnalysis
-	st.SamplesCount = samplesCount
-	st.FocusHistory = append([]FocusPoint(nil), focusHistory...)
-	st.CurrentSessionID = currentSessionID
-	mu.Unlock()
-
-	if err := os.MkdirAll(sessionsDir(), 0o755); err != nil {
-		return err
-	}
-	f, err := os.Create(statePath())
+	app.mu.RLock()
+	st.SessionActive = app.sessionActive
+	st.SessionStart = app.sessionStart
+	st.LastImageFile = app.lastImageFile
+	st.LastAnalysis = app.lastAnalysis
+	st.SamplesCount = app.samplesCount
+	st.FocusHistory = append([]FocusPoint(nil), app.focusHistory...)
+	st.CurrentSessionID = app.currentSessionID
+	st.Downtime = append([]Interval(nil), app.downtime...)
+	st.SessionPaused = app.sessionPaused
+	st.PausedSince = app.pausedSince
+	st.Pauses = append([]Interval(nil), app.pauses...)
+	st.Transitions = append([]Transition(nil), app.transitions...)
+	st.NoiseEvents = append([]NoiseEvent(nil), app.noiseEvents...)
+	st.Distractions = append([]DistractionEvent(nil), app.distractionEvents...)
+	st.SessionUsage = app.sessionUsage
+	st.DailyUsage = maps.Clone(app.dailyUsage)
+	app.mu.RUnlock()
+
+	b, err := encodeState(st)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	return enc.Encode(&st)
+	return writeFileAtomic(app.statePath(), b, true)
 }
 
-func loadState() error {
-	f, err := os.Open(statePath())
+// loadState restores the last good snapshot (falling back to state.gob.bak),
+// upgrading it to the current schema, and replays any newer samples from the
+// write-ahead log.
+func (app *App) loadState() error {
+	var st PersistedState
+	var schema int
+	used, err := readSnapshotWithFallback(app.statePath(), func(b []byte) error {
+		var err error
+		st, schema, err = decodeState(b)
+		return err
+	})
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
 		return err
 	}
-	defer f.Close()
-	var st PersistedState
-	dec := gob.NewDecoder(f)
-	if err := dec.Decode(&st); err != nil {
-		return err
+	if used != app.statePath() {
+		fmt.Printf("state.gob unreadable, recovered from %s\n", used)
+	}
+	recs, walErr := app.store.readWAL()
+	app.mu.Lock()
+	app.sessionActive = st.SessionActive
+	app.sessionStart = st.SessionStart
+	app.lastImageFile = st.LastImageFile
+	app.lastAnalysis = st.LastAnalysis
+	app.samplesCount = st.SamplesCount
+	app.focusHistory = append([]FocusPoint(nil), st.FocusHistory...)
+	app.currentSessionID = st.CurrentSessionID
+	app.downtime = append([]Interval(nil), st.Downtime...)
+	app.sessionPaused = st.SessionPaused
+	app.pausedSince = st.PausedSince
+	app.pauses = append([]Interval(nil), st.Pauses...)
+	app.transitions = append([]Transition(nil), st.Transitions...)
+	app.noiseEvents = append([]NoiseEvent(nil), st.NoiseEvents...)
+	app.distractionEvents = append([]DistractionEvent(nil), st.Distractions...)
+	app.sessionUsage = st.SessionUsage
+	app.dailyUsage = st.DailyUsage
+	replayed := app.replayWALLocked(recs)
+	app.mu.Unlock()
+	if walErr != nil {
+		return fmt.Errorf("read wal: %w", walErr)
+	}
+	if replayed > 0 {
+		fmt.Printf("Replayed %d sample(s) from %s\n", replayed, walFileName)
+	}
+	if schema < currentSchemaVersion {
+		fmt.Printf("Upgrading %s from schema %d to %d\n", stateFileName, schema, currentSchemaVersion)
+		return app.saveState()
 	}
-	mu.Lock()
-	sessionActive = st.SessionActive
-	sessionStart = st.SessionStart
-	lastImageFile = st.LastImageFile
-	lastAnalysis = st.LastAnalysis
-	samplesCount = st.SamplesCount
-	focusHistory = append([]FocusPoint(nil), st.FocusHistory...)
-	currentSessionID = st.CurrentSessionID
-	mu.Unlock()
 	return nil
 }
 
-func saveCompletedSession(s Session) error {
-	if err := os.MkdirAll(sessionsDir(), 0o755); err != nil {
-		return err
+// beginSession starts a new session at the given time and persists it. The
+// caller starts the scheduler if needed.
+func (app *App) beginSession(at time.Time, reason string, auto bool) error {
+	app.mu.Lock()
+	from := app.sessionStateLocked()
+	app.sessionActive = true
+	app.sessionStart = at
+	app.samplesCount = 0
+	app.focusHistory = nil
+	app.currentSessionID = at.Format("20060102-150405")
+	app.downtime = nil
+	app.sessionPaused = false
+	app.pausedSince = time.Time{}
+	app.pauses = nil
+	app.noiseEvents = nil
+	app.distractionEvents = nil
+	app.recentFrames = nil
+	app.sessionUsage = AnalysisUsage{}
+	app.dedup.reset()
+	app.awayStreak = 0
+	app.standbyArmed = false
+	app.transitions = []Transition{{Time: at, From: from, To: stateStudying, Reason: reason, Auto: auto}}
+	app.mu.Unlock()
+	if err := app.store.resetWAL(); err != nil {
+		return fmt.Errorf("resetWAL: %w", err)
 	}
-	fname := filepath.Join(sessionsDir(), fmt.Sprintf("session-%s.gob", s.ID))
-	f, err := os.Create(fname)
-	if err != nil {
-		return err
+	return app.saveState()
+}
+
+// endSession closes the active session at end with an optional reason,
+// persists it and clears the live session state.
+func (app *App) endSession(end time.Time, reason string, auto bool) (Session, error) {
+	app.mu.Lock()
+	wasActive := app.sessionActive
+	if wasActive {
+		to := stateIdle
+		if app.standbyEnabled() {
+			to = stateStandby
+		}
+		app.recordTransitionLocked(end, to, reason, auto)
+	}
+	if app.sessionPaused {
+		app.pauses = append(app.pauses, Interval{Start: app.pausedSince, End: end, Reason: "away"})
+		app.sessionPaused = false
+		app.pausedSince = time.Time{}
+	}
+	s := Session{
+		ID:           app.currentSessionID,
+		Start:        app.sessionStart,
+		End:          end,
+		SamplesCount: app.samplesCount,
+		FocusHistory: append([]FocusPoint(nil), app.focusHistory...),
+		LastAnalysis: app.lastAnalysis,
+		Downtime:     append([]Interval(nil), app.downtime...),
+		Pauses:       append([]Interval(nil), app.pauses...),
+		Transitions:  append([]Transition(nil), app.transitions...),
+		NoiseEvents:  append([]NoiseEvent(nil), app.noiseEvents...),
+		Distractions: append([]DistractionEvent(nil), app.distractionEvents...),
+		Usage:        app.sessionUsage,
+		ClosedReason: reason,
+	}
+	app.sessionActive = false
+	app.currentSessionID = ""
+	app.mu.Unlock()
+	var errs []error
+	if wasActive {
+		if err := app.store.saveSession(s); err != nil {
+			errs = append(errs, fmt.Errorf("saveCompletedSession: %w", err))
+		} else {
+			app.mu.Lock()
+			app.sessions = append(app.sessions, s)
+			app.mu.Unlock()
+		}
+	}
+	if err := app.saveState(); err != nil {
+		errs = append(errs, fmt.Errorf("saveState: %w", err))
+	} else if err := app.store.resetWAL(); err != nil {
+		errs = append(errs, fmt.Errorf("resetWAL: %w", err))
 	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	return enc.Encode(&s)
+	return s, errors.Join(errs...)
 }
 
-func loadAllSessions() error {
-	dir := sessionsDir()
-	entries, err := os.ReadDir(dir)
+// loadAllSessions rereads the completed sessions from disk.
+func (app *App) loadAllSessions() error {
+	loaded, err := app.store.loadSessions()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
 		return err
 	}
-	var loaded []Session
-	for _, ent := range entries {
-		name := ent.Name()
-		if name == stateFileName || !strings.HasSuffix(name, ".gob") || !strings.HasPrefix(name, "session-") {
-			continue
-		}
-		f, err := os.Open(filepath.Join(dir, name))
-		if err != nil {
-			continue
-		}
-		var s Session
-		dec := gob.NewDecoder(f)
-		if err := dec.Decode(&s); err == nil {
+	app.mu.Lock()
+	// Keep sessions that ended while the directory was being read
+	for _, s := range app.sessions {
+		if !slices.ContainsFunc(loaded, func(l Session) bool { return l.ID == s.ID }) {
 			loaded = append(loaded, s)
 		}
-		f.Close()
 	}
-	mu.Lock()
-	sessions = loaded
-	mu.Unlock()
+	app.sessions = loaded
+	app.mu.Unlock()
 	return nil
 }
 
-func listSessionStartTimes() []time.Time {
-	startTimes := make([]time.Time, 0, len(sessions))
-	for _, s := range sessions {
+func (app *App) listSessionStartTimes() []time.Time {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	startTimes := make([]time.Time, 0, len(app.sessions))
+	for _, s := range app.sessions {
 		startTimes = append(startTimes, s.Start)
 	}
 	return startTimes
 }
 
-func runCaptureOnce() (string, string, error) {
-	i, e := runCaptureImageOnce()
-	if e != nil {
-		return "", "", e
-	}
-	a, e2 := runCaptureAudioOnce()
-	if e2 != nil {
-		return i, filepath.Join(dataDir(), "audio.txt"), nil
-		// return "", "", e2
+// pythonCapturer runs the wili scripts, saving into dataDir.
+type pythonCapturer struct {
+	python       string
+	eyeScript    string
+	audioScript  string
+	dataDir      string
+	imageTimeout time.Duration
+	audioTimeout time.Duration
+}
+
+func newPythonCapturer(cfg Config) pythonCapturer {
+	return pythonCapturer{
+		python:       cfg.Capture.Python,
+		eyeScript:    cfg.path(cfg.Paths.EyeScript),
+		audioScript:  cfg.path(cfg.Paths.AudioScript),
+		dataDir:      cfg.path(cfg.Paths.Images),
+		imageTimeout: cfg.Capture.ImageTimeout,
+		audioTimeout: cfg.Capture.AudioTimeout,
 	}
-	return i, a, nil
 }
 
-func runCaptureImageOnce() (string, error) {
-	if err := ensureDirs(); err != nil {
+func (p pythonCapturer) CaptureImage(ctx context.Context, at time.Time) (string, error) {
+	if err := os.MkdirAll(p.dataDir, 0o755); err != nil {
 		return "", err
 	}
-	// Save with timestamp and also update a symlink-like latest name for the SPA
-	ts := time.Now().Format("20060102-150405")
-	out := filepath.Join(dataDir(), fmt.Sprintf("capture-%s.jpg", ts))
+	// Save with the sample timestamp and also update a symlink-like latest name for the SPA
+	ts := at.Format("20060102-150405")
+	out := filepath.Join(p.dataDir, fmt.Sprintf("capture-%s.jpg", ts))
 
-	// Start python: python3 wili/wileye.py --dest <out> with 30s watchdog
+	// Start python: python3 wili/wileye.py --dest <out> with a watchdog (capture.image_timeout)
 	// We stream logs and watch for a completion line ("Image saved to:") then terminate python.
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, p.imageTimeout)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "python3", wiliEyePath(), "--dest", out)
+	cmd := exec.CommandContext(ctx, p.python, p.eyeScript, "--dest", out)
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 	if err := cmd.Start(); err != nil {
@@ -284,7 +406,6 @@ func runCaptureImageOnce() (string, error) {
 
 	done := make(chan error, 1)
 	success := make(chan struct{}, 1)
-	go func() { done <- cmd.Wait() }()
 
 	successRe := regexp.MustCompile(`^Image saved to:`)
 	errorDoneRe := regexp.MustCompile(`Error: Failed to read response frame in 6\.0 seconds`)
@@ -302,8 +423,13 @@ func runCaptureImageOnce() (string, error) {
 			}
 		}
 	}
-	go readPipe(stdout)
-	go readPipe(stderr)
+	// Wait closes the pipes, so only call it once both readers hit EOF;
+	// otherwise a script that exits right after printing loses the line.
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() { defer readers.Done(); readPipe(stdout) }()
+	go func() { defer readers.Done(); readPipe(stderr) }()
+	go func() { readers.Wait(); done <- cmd.Wait() }()
 
 	var gotSuccess bool
 	select {
@@ -326,7 +452,10 @@ func runCaptureImageOnce() (string, error) {
 		}
 	case <-ctx.Done():
 		_ = cmd.Process.Kill()
-		return "", fmt.Errorf("python capture timed out after 30s")
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("python capture timed out after %s", p.imageTimeout)
+		}
+		return "", fmt.Errorf("python capture cancelled: %w", ctx.Err())
 	}
 	if !gotSuccess {
 		return "", fmt.Errorf("capture did not report completion")
@@ -336,7 +465,7 @@ func runCaptureImageOnce() (string, error) {
 	}
 
 	// Also copy to a predictable latest.jpg for easy serving
-	latest := filepath.Join(dataDir(), "latest.jpg")
+	latest := filepath.Join(p.dataDir, "latest.jpg")
 	// Best-effort copy
 	if b, err := os.ReadFile(out); err == nil {
 		_ = os.WriteFile(latest, b, 0o644)
@@ -344,16 +473,27 @@ func runCaptureImageOnce() (string, error) {
 	return out, nil
 }
 
-func runCaptureAudioOnce() (string, error) {
-	if err := ensureDirs(); err != nil {
+func (p pythonCapturer) CaptureAudio(ctx context.Context, at time.Time) (AudioSummary, error) {
+	path, err := p.recordAudio(ctx, at)
+	if err != nil {
+		return AudioSummary{}, err
+	}
+	return readAudio(path)
+}
+
+// recordAudio runs audio.py for the window starting at at and returns the
+// summary file it wrote.
+func (p pythonCapturer) recordAudio(ctx context.Context, at time.Time) (string, error) {
+	if err := os.MkdirAll(p.dataDir, 0o755); err != nil {
 		return "", err
 	}
-	// Start python: python3 wili/audio.py --dest <out> with 30s watchdog
-	// We stream logs and watch for a completion line ("Image saved to:") then terminate python.
-	out := filepath.Join(dataDir(), "audio.txt")
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// Start python: python3 wili/audio.py --dest <out> with a watchdog (capture.audio_timeout)
+	// We stream logs and watch for a completion line ("Audio saved to:") then terminate python.
+	// Each sample gets its own file so a failed capture can never reuse old data.
+	out := filepath.Join(p.dataDir, fmt.Sprintf("audio-%s.json", at.Format("20060102-150405")))
+	ctx, cancel := context.WithTimeout(ctx, p.audioTimeout)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "python3", wiliAudioPath(), "--dest", out)
+	cmd := exec.CommandContext(ctx, p.python, p.audioScript, "--dest", out)
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 	if err := cmd.Start(); err != nil {
@@ -362,7 +502,6 @@ func runCaptureAudioOnce() (string, error) {
 
 	done := make(chan error, 1)
 	success := make(chan struct{}, 1)
-	go func() { done <- cmd.Wait() }()
 
 	successRe := regexp.MustCompile(`^Audio saved to:`)
 	errorDoneRe := regexp.MustCompile(`Error: Failed to read response frame in 6\.0 seconds`)
@@ -380,8 +519,13 @@ func runCaptureAudioOnce() (string, error) {
 			}
 		}
 	}
-	go readPipe(stdout)
-	go readPipe(stderr)
+	// Wait closes the pipes, so only call it once both readers hit EOF;
+	// otherwise a script that exits right after printing loses the line.
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() { defer readers.Done(); readPipe(stdout) }()
+	go func() { defer readers.Done(); readPipe(stderr) }()
+	go func() { readers.Wait(); done <- cmd.Wait() }()
 
 	var gotSuccess bool
 	select {
@@ -404,7 +548,10 @@ func runCaptureAudioOnce() (string, error) {
 		}
 	case <-ctx.Done():
 		_ = cmd.Process.Kill()
-		return "", fmt.Errorf("python audio capture timed out after 30s")
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("python audio capture timed out after %s", p.audioTimeout)
+		}
+		return "", fmt.Errorf("python audio capture cancelled: %w", ctx.Err())
 	}
 	if !gotSuccess {
 		return "", fmt.Errorf("audio capture did not report completion")
@@ -416,81 +563,137 @@ func runCaptureAudioOnce() (string, error) {
 	return out, nil
 }
 
-// readAudio reads a single float64 value from the given file path.
-func readAudio(path string) (float64, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return 0, err
-	}
-
-	str := strings.TrimSpace(string(data))
-	val, err := strconv.ParseFloat(str, 64)
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse float: %w", err)
-	}
-
-	return val, nil
-}
-
-func analyzeImage(path string) (Analysis, error) {
-	// Calls Gemini GenerateContent REST API with inline image bytes and JSON response config
-	key := os.Getenv("GEMINI_API_KEY")
-	if key == "" {
-		key = os.Getenv("GOOGLE_API_KEY")
-	}
-	if key == "" {
-		return Analysis{}, fmt.Errorf("missing API key: set GEMINI_API_KEY or GOOGLE_API_KEY")
+func (app *App) analyzeImage(ctx context.Context, path string) (Analysis, error) {
+	// Calls the model with inline image bytes and JSON response config
+	if err := app.checkBudget(time.Now()); err != nil {
+		return Analysis{}, err
 	}
-
 	imgBytes, err := os.ReadFile(path)
 	if err != nil {
 		return Analysis{}, err
 	}
-	b64 := base64.StdEncoding.EncodeToString(imgBytes)
-
-	// Prompt instructing strict JSON schema
-	prompt := strings.Join([]string{
-		"You are an assistant that evaluates study focus from a webcam-like image. Your POV is from the side of the person's desk/workspace. If they are looking straight ahead or down a little bit, they are likely focused.",
-		"If they have a phone in front of them, they are likely not focused, Ipad or tablet however may be part of homework.",
-		"Return ONLY strict JSON matching this schema with sensible values:",
-		"{\"is_focused\": boolean, \"focus_level\": number, \"is_away\": boolean, \"text_summary\": string}",
-		"- is_focused: true if person appears engaged with screen/books.",
-		"- focus_level: 0.0..1.0 confidence of focus, make sure to use the full range of focus values.",
-		"- is_away: true if no person or clearly not at desk, ignore far away persons in the background.",
-		"- text_summary: one short sentence.",
-	}, "\n")
+	// Prompt instructing strict JSON schema, also enforced as response_schema
+	cfg := app.config()
+	tmpl := app.activePrompt()
+	prompt := tmpl.Text()
+	frames := app.contextFrames(cfg.Analysis.ContextFrames, cfg.Analysis.ContextMaxAge, time.Now())
+	parts, used := analysisParts(frames, cfg.Analysis.ContextMode, imgBytes, prompt)
 
 	reqBody := map[string]any{
 		"contents": []any{
 			map[string]any{
-				"role": "user",
-				"parts": []any{
-					map[string]any{
-						"inline_data": map[string]any{
-							"mime_type": "image/jpeg",
-							"data":      b64,
-						},
-					},
-					map[string]any{"text": prompt},
-				},
+				"role":  "user",
+				"parts": parts,
 			},
 		},
 		"generation_config": map[string]any{
 			"response_mime_type": "application/json",
+			"response_schema":    responseSchema(tmpl),
 		},
 	}
-
 	bodyBytes, _ := json.Marshal(reqBody)
-	url := "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.5-flash:generateContent?key=" + key
-	httpClient := &http.Client{Timeout: 30 * time.Second}
-	resp, err := httpClient.Post(url, "application/json", strings.NewReader(string(bodyBytes)))
+
+	// A reply that fails validation is asked for again rather than stored
+	retries := cfg.Analysis.Retries
+	var invalid error
+	var usage AnalysisUsage
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			fmt.Printf("rejected model reply (%v), retrying %d/%d\n", invalid, attempt, retries)
+		}
+		start := time.Now()
+		text, meta, err := app.analyzer().GenerateContent(ctx, bodyBytes)
+		if err != nil {
+			return Analysis{}, err
+		}
+		u := callUsage(cfg, meta, time.Since(start))
+		app.recordUsage(u, start)
+		usage.add(u)
+		a, err := parseAnalysis(tmpl, text)
+		if err == nil {
+			a.ContextFrames = used
+			a.Usage = &usage
+			return a, nil
+		}
+		invalid = err
+	}
+	return Analysis{}, invalid
+}
+
+const (
+	defaultGeminiBaseURL = "https://generativelanguage.googleapis.com"
+	defaultGeminiModel   = "gemini-2.5-flash"
+)
+
+// geminiAnalyzer calls the Gemini GenerateContent REST API at baseURL (the
+// real one, or e.g. a fakegemini server for tests and offline demos).
+type geminiAnalyzer struct {
+	baseURL string
+	model   string
+	timeout time.Duration
+	keyFile string // gemini.api_key_file, resolved
+}
+
+func newGeminiAnalyzer(cfg Config) geminiAnalyzer {
+	g := geminiAnalyzer{
+		baseURL: strings.TrimRight(cfg.Gemini.BaseURL, "/"),
+		model:   cfg.Gemini.Model,
+		timeout: cfg.Gemini.Timeout,
+	}
+	if cfg.Gemini.APIKeyFile != "" {
+		g.keyFile = cfg.path(cfg.Gemini.APIKeyFile)
+	}
+	return g
+}
+
+// apiKey reads the key from the key file if one is configured, else from
+// GEMINI_API_KEY or GOOGLE_API_KEY.
+func (g geminiAnalyzer) apiKey() (string, error) {
+	if g.keyFile != "" {
+		b, err := os.ReadFile(g.keyFile)
+		if err != nil {
+			return "", fmt.Errorf("gemini.api_key_file: %w", err)
+		}
+		key := strings.TrimSpace(string(b))
+		if key == "" {
+			return "", fmt.Errorf("gemini.api_key_file: %s is empty", g.keyFile)
+		}
+		return key, nil
+	}
+	if key := os.Getenv("GEMINI_API_KEY"); key != "" {
+		return key, nil
+	}
+	return os.Getenv("GOOGLE_API_KEY"), nil
+}
+
+func (g geminiAnalyzer) GenerateContent(ctx context.Context, bodyBytes []byte) (string, usageMetadata, error) {
+	key, err := g.apiKey()
 	if err != nil {
-		return Analysis{}, err
+		return "", usageMetadata{}, err
+	}
+	if key == "" && g.baseURL == defaultGeminiBaseURL {
+		// A stand-in server (gemini.base_url) doesn't need one
+		return "", usageMetadata{}, fmt.Errorf("missing API key: set gemini.api_key_file, GEMINI_API_KEY or GOOGLE_API_KEY")
+	}
+	url := g.baseURL + "/v1beta/models/" + g.model + ":generateContent"
+	httpClient := &http.Client{Timeout: g.timeout}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(string(bodyBytes)))
+	if err != nil {
+		return "", usageMetadata{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		// In a header rather than the URL, which ends up in error messages
+		req.Header.Set("x-goog-api-key", key)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", usageMetadata{}, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
 		b, _ := io.ReadAll(resp.Body)
-		return Analysis{}, fmt.Errorf("gemini error: %s", string(b))
+		return "", usageMetadata{}, fmt.Errorf("gemini error: %s", string(b))
 	}
 	var gen struct {
 		Candidates []struct {
@@ -500,39 +703,32 @@ func analyzeImage(path string) (Analysis, error) {
 				} `json:"parts"`
 			} `json:"content"`
 		} `json:"candidates"`
+		UsageMetadata usageMetadata `json:"usageMetadata"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&gen); err != nil {
-		return Analysis{}, err
+		return "", usageMetadata{}, err
 	}
 	if len(gen.Candidates) == 0 || len(gen.Candidates[0].Content.Parts) == 0 {
-		return Analysis{}, fmt.Errorf("no content from model")
+		return "", usageMetadata{}, fmt.Errorf("no content from model")
 	}
 	text := gen.Candidates[0].Content.Parts[0].Text
 	fmt.Println("Gemini raw response:")
 	fmt.Println(text)
-
-	var a Analysis
-	if err := json.Unmarshal([]byte(text), &a); err != nil {
-		// Try to trim code fences if present
-		cleaned := strings.TrimSpace(text)
-		cleaned = strings.TrimPrefix(cleaned, "```json")
-		cleaned = strings.TrimPrefix(cleaned, "```")
-		cleaned = strings.TrimSuffix(cleaned, "```")
-		if err2 := json.Unmarshal([]byte(strings.TrimSpace(cleaned)), &a); err2 != nil {
-			return Analysis{}, fmt.Errorf("unable to parse model JSON: %v; raw: %s", err2, text)
-		}
-	}
-	return a, nil
+	return text, gen.UsageMetadata, nil
 }
 
-func prevSnapshot(datetime string) Session {
+func (app *App) prevSnapshot(datetime string) Session {
 	t, err := time.Parse(time.RFC3339, datetime)
 	if err != nil {
 		return Session{}
 	}
 
-	for _, s := range sessions {
+	window := app.config().Analysis.SmoothingWindow
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	for _, s := range app.sessions {
 		if s.Start.Equal(t) {
+			s.FocusHistory = smoothFocus(s.FocusHistory, window)
 			return s
 		}
 	}
@@ -540,184 +736,389 @@ func prevSnapshot(datetime string) Session {
 	return Session{}
 }
 
-func snapshot() StudyStats {
-	mu.Lock()
-	defer mu.Unlock()
+func (app *App) snapshot() StudyStats {
+	// Build public URL path for latest image
+	var levels []LevelPoint
+	if mon := app.monitor(); mon != nil {
+		levels, _ = mon.series(time.Now().Add(-statsLevelSpan))
+	}
+	window := app.config().Analysis.SmoothingWindow
+	latestURL := ""
+	if _, err := os.Stat(filepath.Join(app.dataDir(), "latest.jpg")); err == nil {
+		latestURL = "/images/latest.jpg"
+	}
+
+	app.mu.RLock()
+	defer app.mu.RUnlock()
 	var started string
-	var dur int64
-	if !sessionStart.IsZero() {
-		started = sessionStart.Format(time.RFC3339)
-		if sessionActive {
-			dur = int64(time.Since(sessionStart).Seconds())
+	var dur, down, paused int64
+	if !app.sessionStart.IsZero() {
+		started = app.sessionStart.Format(time.RFC3339)
+		if app.sessionActive {
+			now := time.Now()
+			off := downtimeTotal(app.downtime, now)
+			ps := append([]Interval(nil), app.pauses...)
+			if app.sessionPaused {
+				ps = append(ps, Interval{Start: app.pausedSince, End: now})
+			}
+			away := downtimeTotal(ps, now)
+			dur = int64((now.Sub(app.sessionStart) - off - away).Seconds())
+			down = int64(off.Seconds())
+			paused = int64(away.Seconds())
 		} else {
 			dur = 0
 		}
 	}
-	// Build public URL path for latest image
-	latestURL := ""
-	if _, err := os.Stat(filepath.Join(dataDir(), "latest.jpg")); err == nil {
-		latestURL = "/images/latest.jpg"
-	}
 	return StudyStats{
-		Status:          map[bool]string{true: "studying", false: "idle"}[sessionActive],
+		Status:          app.sessionStateLocked(),
 		Timestamp:       time.Now().Format(time.RFC3339),
-		SessionActive:   sessionActive,
+		SessionActive:   app.sessionActive,
 		SessionStarted:  started,
 		DurationSeconds: dur,
-		SamplesCount:    samplesCount,
+		SamplesCount:    app.samplesCount,
 		LastImageURL:    latestURL,
-		LastAnalysis:    lastAnalysis,
-		FocusHistory:    append([]FocusPoint(nil), focusHistory...),
+		LastAnalysis:    app.lastAnalysis,
+		FocusHistory:    smoothFocus(app.focusHistory, window),
+		Audio:           audioStats(app.focusHistory),
+		DowntimeSeconds: down,
+		PausedSeconds:   paused,
+		Transitions:     append([]Transition(nil), app.transitions...),
+		NoiseEvents:     append([]NoiseEvent(nil), app.noiseEvents...),
+		Distractions:    append([]DistractionEvent(nil), app.distractionEvents...),
+		Usage:           app.sessionUsage,
+		UsageToday:      app.dailyUsage[time.Now().Format(time.DateOnly)],
+		Budget:          app.budgetStatusLocked(time.Now()),
+		AudioLevels:     levels,
 	}
 }
 
-func startScheduler(e *echo.Echo) {
-	if tickerStopChan != nil {
-		return
+// startScheduler starts the capture scheduler unless it is running already,
+// and reports whether it started it.
+func (app *App) startScheduler(e *echo.Echo) bool {
+	app.schedMu.Lock()
+	defer app.schedMu.Unlock()
+	if app.tickerStopChan != nil {
+		return false
+	}
+	app.mu.RLock()
+	closing := app.shuttingDown
+	app.mu.RUnlock()
+	if closing {
+		return false
 	}
-	tickerStopChan = make(chan struct{})
-	ticker := time.NewTicker(time.Minute)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	wake := make(chan struct{}, 1)
+	kick := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(app.procCtx)
+	app.tickerStopChan = stop
+	app.schedulerDone = done
+	app.schedulerCancel = cancel
+	app.schedulerWake = wake
+	app.schedulerKick = kick
 	go func() {
-		// Run immediately, then every minute
-		doCaptureCycle(e)
+		defer close(done)
+		defer cancel()
+		// Run immediately, then every minute (or the standby interval)
+		app.doCaptureCycle(ctx, e)
+		last := time.Now()
+		timer := time.NewTimer(app.sampleInterval())
+		defer timer.Stop()
 		for {
 			select {
-			case <-ticker.C:
-				doCaptureCycle(e)
-			case <-tickerStopChan:
-				ticker.Stop()
+			case <-timer.C:
+				app.doCaptureCycle(ctx, e)
+				last = time.Now()
+				timer.Reset(app.sampleInterval())
+			case <-wake:
+				// The interval may have changed; count it from the last cycle
+				timer.Reset(time.Until(last.Add(app.sampleInterval())))
+			case <-kick:
+				app.doCaptureCycle(ctx, e)
+				last = time.Now()
+				timer.Reset(app.sampleInterval())
+			case <-stop:
 				return
 			}
 		}
 	}()
+	return true
 }
 
-func stopScheduler() {
-	if tickerStopChan != nil {
-		close(tickerStopChan)
-		tickerStopChan = nil
+// stopScheduler stops the scheduler and cancels its in-flight capture. The
+// returned channel is closed once the cycle has returned.
+func (app *App) stopScheduler() <-chan struct{} { return app.haltScheduler(true) }
+
+// haltScheduler signals the scheduler to exit, optionally cancelling the
+// capture it is waiting on, and returns a channel closed once it has.
+func (app *App) haltScheduler(cancelInFlight bool) <-chan struct{} {
+	app.schedMu.Lock()
+	defer app.schedMu.Unlock()
+	done := app.schedulerDone
+	if app.tickerStopChan != nil {
+		close(app.tickerStopChan)
+		if cancelInFlight {
+			app.schedulerCancel()
+		}
+		app.tickerStopChan = nil
+		app.schedulerDone = nil
+		app.schedulerCancel = nil
+		app.schedulerWake = nil
+		app.schedulerKick = nil
+	}
+	if done == nil {
+		done = make(chan struct{})
+		close(done)
 	}
+	return done
 }
 
-func doCaptureCycle(e *echo.Echo) {
-	img, aud, err := runCaptureOnce()
-	if err != nil {
-		e.Logger.Error(err)
+func (app *App) doCaptureCycle(ctx context.Context, e *echo.Echo) {
+	if err := app.checkBudget(time.Now()); err != nil {
+		e.Logger.Warnf("skipping sample: %v", err)
 		return
 	}
-	db, err := readAudio(aud)
+	res, err := app.takeSample(ctx)
 	if err != nil {
 		e.Logger.Error(err)
 		return
 	}
-	analysis, err := analyzeImage(img)
-	if err != nil {
-		e.Logger.Error(err)
+	if ctx.Err() != nil {
+		// Stopped or shutting down: don't record a sample whose capture was cut short
 		return
 	}
-	mu.Lock()
-	lastImageFile = img
-	lastAnalysis = analysis
-	samplesCount++
-	focusHistory = append(focusHistory, FocusPoint{Timestamp: time.Now().Format(time.RFC3339),
-		FocusLevel: analysis.FocusLevel, IsFocused: analysis.IsFocused, IsAway: analysis.IsAway, Decibels: db})
-	mu.Unlock()
-	if err := saveState(); err != nil {
-		e.Logger.Warnf("saveState failed: %v", err)
+	app.mu.RLock()
+	active := app.sessionActive
+	app.mu.RUnlock()
+	if !active && !app.standbySample(res.Analysis, res.TakenAt) {
+		return
 	}
+	// A manual capture we joined may have recorded (and saved) it already;
+	// presence is only tracked here, so it counts either way
+	if app.recordSample(res) {
+		if err := app.saveState(); err != nil {
+			e.Logger.Warnf("saveState failed: %v", err)
+		}
+	}
+	app.applyPresence(e, res.Analysis, res.TakenAt)
+}
+
+// recordSample applies a finished capture to the in-memory state and appends
+// it to the write-ahead log so it survives a crash before the next snapshot.
+// A coalesced result is only recorded by the first caller; it reports whether
+// this call recorded it.
+func (app *App) recordSample(res sampleResult) bool {
+	a := res.Analysis
+	fp := FocusPoint{Timestamp: res.TakenAt.Format(time.RFC3339),
+		FocusLevel: a.FocusLevel, IsFocused: a.IsFocused, IsAway: a.IsAway,
+		Decibels: res.Decibels, AudioStatus: res.AudioStatus, Audio: res.Audio, Trigger: res.Trigger, Extra: a.Extra,
+		Deduplicated: a.ReusedFrom != ""}
+	app.mu.Lock()
+	if res.Seq != 0 && res.Seq <= app.lastRecordedSeq {
+		app.mu.Unlock()
+		return false
+	}
+	app.lastRecordedSeq = res.Seq
+	app.lastImageFile = res.ImageFile
+	app.lastAnalysis = a
+	app.samplesCount++
+	app.focusHistory = append(app.focusHistory, fp)
+	app.rememberFrameLocked(res)
+	rec := walRecord{SessionID: app.currentSessionID, Index: len(app.focusHistory) - 1, ImageFile: res.ImageFile, Analysis: a, Point: fp}
+	app.mu.Unlock()
+	if rec.SessionID != "" {
+		if err := app.store.appendWAL(rec); err != nil {
+			fmt.Printf("appendWAL failed: %v\n", err)
+		}
+	}
+	return true
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
 	e := echo.New()
 
-	// Load .env from repo root if present
-	if root := findRepoRoot(); root != "" {
-		repoRoot = root
-		if err := loadDotEnv(filepath.Join(root, ".env")); err != nil {
-			e.Logger.Warnf(".env not loaded: %v", err)
-		} else {
-			e.Logger.Printf("Loaded .env from %s", root)
-		}
+	cfg, err := loadConfig("", os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
 	}
-
-	if err := ensureDirs(); err != nil {
+	if err != nil {
 		e.Logger.Fatal(err)
 	}
+	e.Logger.Printf("Repo root %s (%s)", cfg.Root, cfg.Sources["root"])
+	if cfg.EnvFile != "" {
+		e.Logger.Printf("Loaded .env from %s", cfg.EnvFile)
+	}
+	if cfg.File != "" {
+		e.Logger.Printf("Loaded config from %s", cfg.File)
+	}
+	app := NewApp(cfg)
+	if err := app.ensureDirs(); err != nil {
+		e.Logger.Fatal(err)
+	}
+	if err := app.initPrompt(); err != nil {
+		e.Logger.Warnf("prompt not loaded, using built-in %s: %v", defaultPromptID, err)
+	}
+	e.Logger.Printf("Analysis prompt: %s", app.activePrompt().ID)
 
 	// Load previous state and sessions if available
-	if err := loadState(); err != nil {
+	if err := app.loadState(); err != nil {
 		e.Logger.Warnf("loadState failed: %v", err)
 	}
-	if err := loadAllSessions(); err != nil {
+	if err := app.loadAllSessions(); err != nil {
 		e.Logger.Warnf("loadAllSessions failed: %v", err)
 	}
-	// If session was active, resume scheduler
-	if sessionActive {
-		startScheduler(e)
+	if m := app.startAudioMonitor(); m != nil {
+		e.Logger.Printf("Audio monitor on (resolution %s, window %s)", m.resolution, m.window)
+	}
+
+	// If session was active, account for the outage and resume the scheduler
+	active, err := app.recoverActiveSession(time.Now())
+	if err != nil {
+		e.Logger.Warnf("session recovery: %v", err)
+	}
+	if active {
+		app.startScheduler(e)
+	} else if app.standbyEnabled() {
+		app.enterStandby(e, false)
+	}
+
+	RegisterRoutes(e, app)
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// SIGHUP reloads the config
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			res, err := app.reload()
+			if err != nil {
+				e.Logger.Errorf("config reload failed, keeping the old config: %v", err)
+				continue
+			}
+			e.Logger.Printf("Config reloaded: changed %v", res.Changed)
+			if len(res.Restart) > 0 {
+				e.Logger.Warnf("restart required for %v", res.Restart)
+			}
+			if res.PromptError != "" {
+				e.Logger.Warnf("prompt not loaded, using built-in %s: %s", defaultPromptID, res.PromptError)
+			}
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(cfg.Server.Addr)
+	if host == "" {
+		host = "localhost"
+	}
+	e.Logger.Printf("Serving on %s. Open http://%s/", cfg.Server.Addr, net.JoinHostPort(host, port))
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- e.Start(cfg.Server.Addr) }()
+
+	select {
+	case err := <-serveErr:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	case <-sigCtx.Done():
+		stop()
+		e.Logger.Printf("Shutdown requested, finalizing...")
+		app.shutdown(e)
 	}
+}
 
-	RegisterRoutes(e)
+// wakeScheduler makes a running scheduler re-read its interval.
+func (app *App) wakeScheduler() {
+	app.schedMu.Lock()
+	defer app.schedMu.Unlock()
+	select {
+	case app.schedulerWake <- struct{}{}:
+	default: // not running, or already woken
+	}
+}
 
-	e.Logger.Printf("Serving on :8085. Open http://localhost:8085/")
-	e.Logger.Fatal(e.Start(":8085"))
+// kickScheduler makes a running scheduler take a sample now and count the
+// interval from there, e.g. for a session started while standby sampling.
+func (app *App) kickScheduler() {
+	app.schedMu.Lock()
+	defer app.schedMu.Unlock()
+	select {
+	case app.schedulerKick <- struct{}{}:
+	default: // not running, or already kicked
+	}
 }
 
-// ---- .env loader (repo-root) ----
+// ---- Shutdown ----
+
+const (
+	// How long an in-flight capture cycle may run on after a shutdown signal
+	// before its python children are killed.
+	captureGracePeriod = 15 * time.Second
+	// Deadline for Echo to drain open requests.
+	httpShutdownTimeout = 10 * time.Second
+)
+
+// shutdown stops the scheduler, finalizes or cancels the in-flight capture,
+// drains HTTP and writes a final state snapshot.
+func (app *App) shutdown(e *echo.Echo) {
+	app.mu.Lock()
+	app.shuttingDown = true
+	app.mu.Unlock()
 
+	// Let the current cycle finish if it can; otherwise kill its children
+	done := app.haltScheduler(false)
+	select {
+	case <-done:
+	case <-time.After(captureGracePeriod):
+		e.Logger.Warnf("capture still running after %s, killing child processes", captureGracePeriod)
+		app.cancelProcs()
+		<-done
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		e.Logger.Warnf("http shutdown: %v", err)
+		app.cancelProcs()
+		_ = e.Close()
+	}
+	// Nothing should be running past this point
+	app.cancelProcs()
+
+	if err := app.saveState(); err != nil {
+		e.Logger.Errorf("final saveState failed: %v", err)
+		return
+	}
+	e.Logger.Printf("State saved, bye")
+}
+
+// ---- Repo root ----
+
+// findRepoRoot looks for the repo root (the directory holding BaseStation/
+// and the wili scripts) from the working directory upwards. It is the
+// fallback when neither -root nor BASESTATION_ROOT says where it is.
 func findRepoRoot() string {
-	cwd, _ := os.Getwd()
-	dir := cwd
-	for i := 0; i < 6; i++ {
-		// Heuristics: .git or wileye/wileye.py existing from this dir
-		if fileExists(filepath.Join(dir, ".env")) ||
-			fileExists(filepath.Join(dir, ".git")) ||
-			fileExists(filepath.Join(dir, wiliEyeScriptRel)) ||
-			fileExists(filepath.Join(dir, wiliAudioScriptRel)) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		if fileExists(filepath.Join(dir, "BaseStation")) && fileExists(filepath.Join(dir, wiliEyeScriptRel)) {
 			return dir
 		}
 		parent := filepath.Dir(dir)
 		if parent == dir {
-			break
+			return ""
 		}
 		dir = parent
 	}
-	return ""
 }
 
 func fileExists(p string) bool {
 	_, err := os.Stat(p)
 	return err == nil
 }
-
-func loadDotEnv(path string) error {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return err
-	}
-	lines := strings.Split(string(b), "\n")
-	// Simple KEY=VALUE parser, ignores comments and blank lines
-	re := regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.*)\s*$`)
-	for _, ln := range lines {
-		ln = strings.TrimSpace(ln)
-		if ln == "" || strings.HasPrefix(ln, "#") {
-			continue
-		}
-		m := re.FindStringSubmatch(ln)
-		if len(m) != 3 {
-			continue
-		}
-		k, v := m[1], m[2]
-		// Trim surrounding quotes if present
-		v = strings.TrimSpace(v)
-		if strings.HasPrefix(v, "\"") && strings.HasSuffix(v, "\"") && len(v) >= 2 {
-			v = strings.Trim(v, "\"")
-		} else if strings.HasPrefix(v, "'") && strings.HasSuffix(v, "'") && len(v) >= 2 {
-			v = strings.Trim(v, "'")
-		}
-		// Do not override if already set
-		if _, exists := os.LookupEnv(k); !exists {
-			_ = os.Setenv(k, v)
-		}
-	}
-	return nil
-}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ----- Presence-driven sessions -----
+//
+// With presence.mode = pause|stop, presence.away_samples consecutive is_away
+// samples pause (or end) the active session. A paused session keeps sampling
+// and resumes on the first sample with someone at the desk.
+//
+// With presence.standby the scheduler keeps running between sessions at
+// presence.standby_interval and starts a session when a person sits down.
+// After a manual stop the person is usually still at the desk, so standby
+// only triggers once it has seen the desk empty.
+//
+// Every state change, manual or automatic, is recorded as a Transition.
+
+const (
+	presenceModePause = "pause"
+	presenceModeStop  = "stop"
+
+	defaultAwaySamples     = 3
+	defaultStandbyInterval = 2 * time.Minute
+
+	stateIdle     = "idle"
+	stateStudying = "studying"
+	statePaused   = "paused"
+	stateStandby  = "standby"
+)
+
+// Transition is one change of session state.
+type Transition struct {
+	Time   time.Time `json:"time"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason,omitempty"`
+	Auto   bool      `json:"auto"`
+}
+
+func (app *App) standbyEnabled() bool { return app.config().Presence.Standby }
+
+// sampleInterval is the scheduler period for the current state.
+func (app *App) sampleInterval() time.Duration {
+	app.mu.RLock()
+	active := app.sessionActive
+	budget := app.budgetStatusLocked(time.Now())
+	app.mu.RUnlock()
+	cfg := app.config()
+	if !active {
+		return cfg.Presence.StandbyInterval
+	}
+	if budget.Exceeded && budget.Action == budgetActionSlow {
+		return time.Duration(cfg.Budget.SlowFactor) * cfg.Capture.Interval
+	}
+	return cfg.Capture.Interval
+}
+
+// sessionStateLocked names the current state for transitions and the
+// dashboard. Caller must hold mu.
+func (app *App) sessionStateLocked() string {
+	switch {
+	case app.sessionActive && app.sessionPaused:
+		return statePaused
+	case app.sessionActive:
+		return stateStudying
+	case app.standbyArmed:
+		return stateStandby
+	}
+	return stateIdle
+}
+
+// recordTransitionLocked appends to the current session's transitions.
+// Caller must hold mu.
+func (app *App) recordTransitionLocked(at time.Time, to, reason string, auto bool) {
+	app.transitions = append(app.transitions, Transition{Time: at, From: app.sessionStateLocked(), To: to, Reason: reason, Auto: auto})
+}
+
+// enterStandby arms standby sampling and makes sure the scheduler runs.
+// sawAway says whether the desk is already known to be empty.
+func (app *App) enterStandby(e *echo.Echo, sawAway bool) {
+	app.mu.Lock()
+	app.standbyArmed = true
+	app.standbyClearedDesk = sawAway
+	app.mu.Unlock()
+	app.startScheduler(e)
+}
+
+// standbySample handles a sample taken while no session is active and reports
+// whether it started one (in which case the sample belongs to it).
+func (app *App) standbySample(a Analysis, at time.Time) bool {
+	app.mu.Lock()
+	armed := app.standbyArmed
+	if a.IsAway {
+		app.standbyClearedDesk = true
+	}
+	ready := armed && app.standbyClearedDesk && !a.IsAway
+	app.mu.Unlock()
+	if !ready {
+		return false
+	}
+	if err := app.beginSession(at, "person detected at desk", true); err != nil {
+		fmt.Printf("auto-start failed: %v\n", err)
+	}
+	return true
+}
+
+// applyPresence updates the away streak after a recorded sample and pauses,
+// resumes or stops the session as configured.
+func (app *App) applyPresence(e *echo.Echo, a Analysis, at time.Time) {
+	cfg := app.config()
+	mode := cfg.Presence.Mode
+	app.mu.Lock()
+	if !app.sessionActive {
+		app.mu.Unlock()
+		return
+	}
+	if !a.IsAway {
+		app.awayStreak = 0
+		if app.sessionPaused {
+			app.pauses = append(app.pauses, Interval{Start: app.pausedSince, End: at, Reason: "away"})
+			app.recordTransitionLocked(at, stateStudying, "person returned", true)
+			app.sessionPaused = false
+			app.pausedSince = time.Time{}
+		}
+		app.mu.Unlock()
+		return
+	}
+	if app.awayStreak == 0 {
+		app.awaySince = at
+	}
+	app.awayStreak++
+	n := app.awayStreak
+	since := app.awaySince
+	trigger := mode != "" && !app.sessionPaused && n >= cfg.Presence.AwaySamples
+	if trigger && mode == presenceModePause {
+		app.recordTransitionLocked(since, statePaused, fmt.Sprintf("away for %d samples", n), true)
+		app.sessionPaused = true
+		app.pausedSince = since
+	}
+	app.mu.Unlock()
+	if !trigger || mode != presenceModeStop {
+		return
+	}
+
+	if _, err := app.endSession(since, fmt.Sprintf("auto-stopped: away for %d samples", n), true); err != nil {
+		e.Logger.Warnf("auto-stop: %v", err)
+	}
+	if cfg.Presence.Standby {
+		app.enterStandby(e, true)
+	} else {
+		app.stopScheduler()
+	}
+}
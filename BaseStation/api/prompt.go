@@ -0,0 +1,249 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ----- Analysis prompt templates -----
+//
+// The focus prompt is a template: free-form instructions plus the list of JSON
+// fields the model must return. prompt.id picks the template (default
+// focus-v1). Templates are read from paths.prompts (default
+// <repoRoot>/BaseStation/prompts) and fall back to the ones built in from
+// api/prompts.
+//
+// prompt.device and prompt.user layer device-<name>.json and user-<name>.json
+// from the same directory on top, in that order. An override may replace the
+// instructions, append extra_instructions, and add or redescribe fields.
+//
+// Fields beyond the four core ones end up in Analysis.Extra and
+// FocusPoint.Extra. The resolved prompt ID (e.g. focus-v1+device-desk) is
+// stored with every Analysis.
+
+const (
+	defaultPromptID = "focus-v1"
+	promptsDirRel   = "BaseStation/prompts"
+)
+
+//go:embed prompts/*.json
+var builtinPrompts embed.FS
+
+// Field types a template may declare
+var promptFieldTypes = []string{"boolean", "number", "string"}
+
+// The fields Analysis has first-class support for
+var corePromptFields = []string{"is_focused", "focus_level", "is_away", "text_summary"}
+
+type PromptField struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+// PromptTemplate is a prompt file, or the result of layering overrides on one.
+type PromptTemplate struct {
+	ID                string        `json:"id"`
+	Instructions      []string      `json:"instructions,omitempty"`
+	ExtraInstructions []string      `json:"extra_instructions,omitempty"`
+	Fields            []PromptField `json:"fields,omitempty"`
+}
+
+// Text renders the prompt sent along with the image.
+func (p PromptTemplate) Text() string {
+	lines := append([]string(nil), p.Instructions...)
+	lines = append(lines, p.ExtraInstructions...)
+	schema := make([]string, len(p.Fields))
+	for i, f := range p.Fields {
+		schema[i] = fmt.Sprintf("%q: %s", f.Name, f.Type)
+	}
+	lines = append(lines,
+		"Return ONLY strict JSON matching this schema with sensible values:",
+		"{"+strings.Join(schema, ", ")+"}")
+	for _, f := range p.Fields {
+		lines = append(lines, fmt.Sprintf("- %s: %s", f.Name, f.Description))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// extraFields are the declared fields that are not part of Analysis proper.
+func (p PromptTemplate) extraFields() []PromptField {
+	var out []PromptField
+	for _, f := range p.Fields {
+		if !slices.Contains(corePromptFields, f.Name) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// apply layers an override on top of p.
+func (p PromptTemplate) apply(o PromptTemplate) PromptTemplate {
+	p.ID += "+" + o.ID
+	if len(o.Instructions) > 0 {
+		p.Instructions = o.Instructions
+	}
+	p.ExtraInstructions = append(slices.Clone(p.ExtraInstructions), o.ExtraInstructions...)
+	p.Fields = slices.Clone(p.Fields)
+	for _, f := range o.Fields {
+		if i := slices.IndexFunc(p.Fields, func(g PromptField) bool { return g.Name == f.Name }); i >= 0 {
+			p.Fields[i] = f
+		} else {
+			p.Fields = append(p.Fields, f)
+		}
+	}
+	return p
+}
+
+func (p PromptTemplate) validate() error {
+	if len(p.Instructions) == 0 {
+		return errors.New("no instructions")
+	}
+	for _, name := range corePromptFields {
+		if !slices.ContainsFunc(p.Fields, func(f PromptField) bool { return f.Name == name }) {
+			return fmt.Errorf("missing core field %q", name)
+		}
+	}
+	for _, f := range p.Fields {
+		if f.Name == "" || !slices.Contains(promptFieldTypes, f.Type) {
+			return fmt.Errorf("field %q: type must be one of %s", f.Name, strings.Join(promptFieldTypes, ", "))
+		}
+	}
+	return nil
+}
+
+func (app *App) promptsDir() string {
+	cfg := app.config()
+	return cfg.path(cfg.Paths.Prompts)
+}
+
+// readPromptFile reads name.json from the prompts directory dir, falling back to
+// the built-in copy. The ID defaults to the file name.
+func readPromptFile(dir, name string) (PromptTemplate, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		if b, berr := builtinPrompts.ReadFile("prompts/" + name + ".json"); berr == nil {
+			data, err = b, nil
+		}
+	}
+	if err != nil {
+		return PromptTemplate{}, fmt.Errorf("prompt %s: %w", name, err)
+	}
+	return decodePrompt(name, data)
+}
+
+func decodePrompt(name string, data []byte) (PromptTemplate, error) {
+	var p PromptTemplate
+	if err := json.Unmarshal(data, &p); err != nil {
+		return PromptTemplate{}, fmt.Errorf("prompt %s: %w", name, err)
+	}
+	if p.ID == "" {
+		p.ID = name
+	}
+	return p, nil
+}
+
+// builtinPrompt is the default template as built in, ignoring any copy in
+// paths.prompts: the fallback when the configured prompt can't be used, which
+// may be because that copy is broken.
+func builtinPrompt() (PromptTemplate, error) {
+	b, err := builtinPrompts.ReadFile("prompts/" + defaultPromptID + ".json")
+	if err != nil {
+		return PromptTemplate{}, fmt.Errorf("prompt %s: %w", defaultPromptID, err)
+	}
+	p, err := decodePrompt(defaultPromptID, b)
+	if err != nil {
+		return PromptTemplate{}, err
+	}
+	p.ID = defaultPromptID
+	if err := p.validate(); err != nil {
+		return PromptTemplate{}, fmt.Errorf("built-in prompt %s: %w", defaultPromptID, err)
+	}
+	return p, nil
+}
+
+// loadPrompt resolves cfg's prompt.id with the device and user overrides.
+func loadPrompt(dir string, cfg Config) (PromptTemplate, error) {
+	p, err := readPromptFile(dir, cfg.Prompt.ID)
+	if err != nil {
+		return PromptTemplate{}, err
+	}
+	for _, layer := range []struct{ kind, name string }{{"device", cfg.Prompt.Device}, {"user", cfg.Prompt.User}} {
+		name := layer.name
+		if name == "" {
+			continue
+		}
+		o, err := readPromptFile(dir, layer.kind+"-"+name)
+		if err != nil {
+			return PromptTemplate{}, err
+		}
+		p = p.apply(o)
+	}
+	if err := p.validate(); err != nil {
+		return PromptTemplate{}, fmt.Errorf("prompt %s: %w", p.ID, err)
+	}
+	return p, nil
+}
+
+// initPrompt loads the configured prompt, keeping the built-in default if it
+// can't be loaded.
+func (app *App) initPrompt() error {
+	p, err := loadPrompt(app.promptsDir(), app.config())
+	if err != nil {
+		p, _ = builtinPrompt()
+	}
+	app.promptMu.Lock()
+	app.currentPrompt = p
+	app.promptMu.Unlock()
+	return err
+}
+
+func (app *App) activePrompt() PromptTemplate {
+	app.promptMu.Lock()
+	defer app.promptMu.Unlock()
+	if app.currentPrompt.ID == "" {
+		// Not initialized (e.g. migrate subcommand): built-in default
+		app.currentPrompt, _ = builtinPrompt()
+	}
+	return app.currentPrompt
+}
+
+// parseExtraFields picks the template's extra fields out of the model's JSON
+// reply. Values of the wrong type are dropped.
+func parseExtraFields(p PromptTemplate, raw map[string]json.RawMessage) map[string]any {
+	var out map[string]any
+	for _, f := range p.extraFields() {
+		msg, ok := raw[f.Name]
+		if !ok {
+			continue
+		}
+		var v any
+		if err := json.Unmarshal(msg, &v); err != nil {
+			continue
+		}
+		switch v.(type) {
+		case bool:
+			ok = f.Type == "boolean"
+		case float64:
+			ok = f.Type == "number"
+		case string:
+			ok = f.Type == "string"
+		default:
+			ok = false
+		}
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = map[string]any{}
+		}
+		out[f.Name] = v
+	}
+	return out
+}
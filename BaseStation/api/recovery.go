@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ----- Restart recovery -----
+//
+// If the station comes back with a session still marked active, the time since
+// the last FocusPoint was spent with nothing watching. Gaps up to a few sample
+// intervals are the normal wait for the next tick and are ignored (or up to
+// session.downtime_gap if set); longer ones are recorded as a downtime
+// interval (excluded from the session duration), and with
+// session.idle_close_after set a session idle for longer than that is closed
+// at its last sample instead of resumed. A pause still open at the restart is
+// closed at the last sample and reopened after the downtime, so the outage
+// isn't subtracted twice.
+
+const (
+	// Gaps shorter than this many sample intervals are normal scheduling
+	// jitter, not downtime.
+	downtimeGapIntervals = 3
+)
+
+// Interval is a span of wall-clock time excluded from a session's duration.
+type Interval struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason"`
+}
+
+func (iv Interval) Duration() time.Duration { return iv.End.Sub(iv.Start) }
+
+// downtimeGap is how long the station may be silent before it counts as down.
+func (app *App) downtimeGap() time.Duration {
+	if gap := app.config().Session.DowntimeGap; gap > 0 {
+		return gap
+	}
+	return downtimeGapIntervals * app.sampleInterval()
+}
+
+// lastActivityLocked returns the time of the last FocusPoint, or the session
+// start when there are none. Caller must hold mu.
+func (app *App) lastActivityLocked() time.Time {
+	for i := len(app.focusHistory) - 1; i >= 0; i-- {
+		if t, err := time.Parse(time.RFC3339, app.focusHistory[i].Timestamp); err == nil {
+			return t
+		}
+	}
+	return app.sessionStart
+}
+
+// recoverActiveSession inspects a session restored from disk and either
+// records the outage as downtime or auto-closes it. It reports whether the
+// session is still active afterwards.
+func (app *App) recoverActiveSession(now time.Time) (bool, error) {
+	app.mu.RLock()
+	if !app.sessionActive {
+		app.mu.RUnlock()
+		return false, nil
+	}
+	last := app.lastActivityLocked()
+	app.mu.RUnlock()
+
+	gap := now.Sub(last)
+	if last.IsZero() || gap < app.downtimeGap() {
+		return true, nil
+	}
+	if limit := app.config().Session.IdleCloseAfter; limit > 0 && gap > limit {
+		reason := fmt.Sprintf("auto-closed after restart: idle for %s", gap.Round(time.Minute))
+		if _, err := app.endSession(last, reason, true); err != nil {
+			return false, err
+		}
+		fmt.Printf("Session closed at last sample %s (%s)\n", last.Format(time.RFC3339), reason)
+		return false, nil
+	}
+
+	app.mu.Lock()
+	app.downtime = append(app.downtime, Interval{Start: last, End: now, Reason: "station offline"})
+	if app.sessionPaused {
+		if app.pausedSince.Before(last) {
+			app.pauses = append(app.pauses, Interval{Start: app.pausedSince, End: last, Reason: "away"})
+		}
+		app.pausedSince = now
+	}
+	app.mu.Unlock()
+	fmt.Printf("Recorded %s of downtime in active session\n", gap.Round(time.Second))
+	return true, app.saveState()
+}
+
+// downtimeTotal sums intervals clipped to end.
+func downtimeTotal(ivs []Interval, end time.Time) time.Duration {
+	var total time.Duration
+	for _, iv := range ivs {
+		e := iv.End
+		if e.After(end) {
+			e = end
+		}
+		if e.After(iv.Start) {
+			total += e.Sub(iv.Start)
+		}
+	}
+	return total
+}
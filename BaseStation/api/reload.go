@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ----- Config reload -----
+//
+// SIGHUP or POST /api/admin/reload (guarded by server.admin_token if set)
+// loads the config file and the environment again, with the startup flags on
+// top, and applies the result to the running station:
+//   - capture.interval: a running scheduler re-times its next tick from the
+//     last cycle,
+//   - the prompt templates are read again from paths.prompts,
+//   - retention.*: finished jobs and old usage days are pruned right away,
+//   - capture.* and gemini.*: the python capturer and Gemini analyzer are
+//     rebuilt. Backends set by the embedder (tests, fakes) are left alone,
+//   - audio.* and capture.python: the audio monitor is restarted (or
+//     started, or stopped) with the new settings,
+//   - the tuning sections (analysis, dedup, budget, presence, trigger,
+//     session) are read where they are used and apply from the next sample.
+//
+// Session state and an active session are untouched. The repo root and keys
+// tagged restart (server.addr, paths.*) keep their running value and are
+// reported instead.
+// A config that fails to load or validate changes nothing.
+
+// ReloadResult is what a reload changed.
+type ReloadResult struct {
+	Changed []string `json:"changed"`          // keys now in effect
+	Restart []string `json:"restart_required"` // changed keys ignored until restart
+	Prompt  string   `json:"prompt"`           // analysis prompt in use
+	// PromptError is set when the prompt could not be loaded and the
+	// built-in default is used instead.
+	PromptError string `json:"prompt_error,omitempty"`
+}
+
+// reload loads the configuration again and applies it.
+func (app *App) reload() (ReloadResult, error) {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	old := app.config()
+	next, err := loadConfig(old.Root, old.args)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	res := ReloadResult{Changed: []string{}, Restart: []string{}}
+	if next.Root != old.Root {
+		next.Root, next.Sources["root"] = old.Root, old.Sources["root"]
+		res.Restart = append(res.Restart, "root")
+	}
+	restartMonitor := false
+	oldFields, nextFields := old.fields(), next.fields()
+	for i, f := range nextFields {
+		prev := oldFields[i]
+		if reflect.DeepEqual(f.v.Interface(), prev.v.Interface()) {
+			continue
+		}
+		if f.restart {
+			f.v.Set(prev.v)
+			next.Sources[f.key] = old.Sources[f.key]
+			res.Restart = append(res.Restart, f.key)
+			continue
+		}
+		res.Changed = append(res.Changed, f.key)
+		if strings.HasPrefix(f.key, "audio.") || f.key == "capture.python" {
+			restartMonitor = true
+		}
+	}
+
+	app.cfgMu.Lock()
+	app.cfg = next
+	if _, ok := app.Capturer.(pythonCapturer); ok {
+		app.Capturer = newPythonCapturer(next)
+	}
+	if _, ok := app.Analyzer.(geminiAnalyzer); ok {
+		app.Analyzer = newGeminiAnalyzer(next)
+	}
+	app.cfgMu.Unlock()
+	if restartMonitor {
+		app.startAudioMonitor()
+	}
+
+	if err := app.initPrompt(); err != nil {
+		res.PromptError = err.Error()
+	}
+	res.Prompt = app.activePrompt().ID
+
+	app.jobs.mu.Lock()
+	app.jobs.pruneLocked(time.Now())
+	app.jobs.mu.Unlock()
+	app.mu.Lock()
+	app.pruneDailyUsageLocked()
+	app.mu.Unlock()
+
+	app.wakeScheduler()
+	return res, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReloadAppliesToRunningSession(t *testing.T) {
+	h := newHarness(t)
+	h.startSession()
+	before := h.stats()
+
+	writeConfig(t, h.root, `
+[server]
+addr = ":9999"
+
+[capture]
+interval = "50ms"
+
+[gemini]
+model = "reloaded-model"
+
+[retention]
+usage_days = 7
+`)
+	var res ReloadResult
+	if code := h.do(http.MethodPost, "/api/admin/reload", nil, &res); code != http.StatusOK {
+		t.Fatalf("reload: status %d", code)
+	}
+	if want := []string{"capture.interval", "gemini.model", "retention.usage_days"}; !slices.Equal(res.Changed, want) {
+		t.Errorf("changed = %v, want %v", res.Changed, want)
+	}
+	if want := []string{"server.addr"}; !slices.Equal(res.Restart, want) {
+		t.Errorf("restart_required = %v, want %v", res.Restart, want)
+	}
+	if res.Prompt != defaultPromptID {
+		t.Errorf("prompt = %q, want %q", res.Prompt, defaultPromptID)
+	}
+	cfg := h.app.config()
+	if cfg.Server.Addr != ":8085" || cfg.Capture.Interval != 50*time.Millisecond || cfg.Retention.UsageDays != 7 {
+		t.Errorf("config after reload: addr %s, interval %s, usage days %d", cfg.Server.Addr, cfg.Capture.Interval, cfg.Retention.UsageDays)
+	}
+
+	// The running scheduler picks up the new interval and the session goes on
+	h.waitFor("samples at the new interval", func() bool { return h.stats().SamplesCount >= 3 })
+	after := h.stats()
+	if !after.SessionActive || after.SessionStarted != before.SessionStarted {
+		t.Errorf("session after reload: active %v, started %q, want %q", after.SessionActive, after.SessionStarted, before.SessionStarted)
+	}
+	reqs := h.gemini.Requests()
+	if got := reqs[len(reqs)-1].Model; got != "reloaded-model" {
+		t.Errorf("model after reload = %q, want reloaded-model", got)
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	h := newHarness(t)
+	writeConfig(t, h.root, "[capture]\ninterval = \"-1s\"\n")
+
+	h.configure(func(c *Config) { c.Server.AdminToken = "secret" })
+	if code := h.do(http.MethodPost, "/api/admin/reload", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("reload without token: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	h.configure(func(c *Config) { c.Server.AdminToken = "" })
+	var res struct{ Error string }
+	if code := h.do(http.MethodPost, "/api/admin/reload", nil, &res); code != http.StatusInternalServerError {
+		t.Fatalf("reload of a bad config: status %d, want %d", code, http.StatusInternalServerError)
+	}
+	if got := h.app.config().Capture.Interval; got != time.Minute {
+		t.Errorf("interval = %s after a failed reload, want the old 1m0s", got)
+	}
+}
+
+func TestReloadTakesDotEnvChanges(t *testing.T) {
+	h := newHarness(t)
+	os.Unsetenv("GEMINI_MODEL") // set empty by the harness, which would win over .env
+	envFile := filepath.Join(h.root, ".env")
+	for _, c := range []struct{ env, want string }{
+		{"GEMINI_MODEL=first\n", "first"},
+		{"GEMINI_MODEL=second\n", "second"},
+		{"# GEMINI_MODEL=second\n", defaultGeminiModel},
+	} {
+		writeFile(t, envFile, c.env)
+		if _, err := h.app.reload(); err != nil {
+			t.Fatal(err)
+		}
+		if got := h.app.config().Gemini.Model; got != c.want {
+			t.Errorf(".env %q: gemini.model = %q, want %q", c.env, got, c.want)
+		}
+	}
+}
+
+func TestReloadRestartsAudioMonitor(t *testing.T) {
+	h := newHarness(t)
+	if h.app.monitor() != nil {
+		t.Fatal("audio monitor running with audio.monitor off")
+	}
+	var prev *audioMonitor
+	for _, c := range []struct {
+		file string
+		want time.Duration // 0: no monitor
+	}{
+		{"[audio]\nmonitor = true\n", time.Second},
+		{"[audio]\nmonitor = true\nresolution = \"2s\"\n", 2 * time.Second},
+		{"", 0},
+	} {
+		writeConfig(t, h.root, c.file)
+		if _, err := h.app.reload(); err != nil {
+			t.Fatal(err)
+		}
+		if prev != nil {
+			select {
+			case <-prev.done:
+			default:
+				t.Errorf("%q: the old monitor is still running", c.file)
+			}
+		}
+		m := h.app.monitor()
+		switch {
+		case c.want == 0 && m != nil:
+			t.Errorf("%q: audio monitor still running", c.file)
+		case c.want != 0 && (m == nil || m == prev || m.resolution != c.want):
+			t.Errorf("%q: monitor %p (was %p), want a new one at %s", c.file, m, prev, c.want)
+		}
+		prev = m
+	}
+}
+
+func TestBrokenPromptFallsBackToBuiltin(t *testing.T) {
+	h := newHarness(t)
+	local := filepath.Join(h.root, promptsDirRel, defaultPromptID+".json")
+	for _, data := range []string{`{"fields": []}`, `{not json`} {
+		writeFile(t, local, data)
+		if err := h.app.initPrompt(); err == nil {
+			t.Errorf("%s: initPrompt: no error", data)
+		}
+		p := h.app.activePrompt()
+		if err := p.validate(); err != nil || p.ID != defaultPromptID {
+			t.Errorf("%s: fallback prompt %q: %v", data, p.ID, err)
+		}
+	}
+}
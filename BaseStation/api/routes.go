@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/subtle"
+	"maps"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -10,8 +13,8 @@ import (
 	"k8s.io/klog/v2"
 )
 
-// RegisterRoutes attaches all HTTP routes and middleware to Echo.
-func RegisterRoutes(e *echo.Echo) {
+// RegisterRoutes attaches all HTTP routes and middleware for app to Echo.
+func RegisterRoutes(e *echo.Echo, app *App) {
 	// Request logging via custom logger
 	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
 		LogLatency:    true,
@@ -24,119 +27,193 @@ func RegisterRoutes(e *echo.Echo) {
 	}))
 
 	// Static files and images
-	// Static dir relative to repo root
-	staticDir := filepath.Join(repoRoot, staticDirRel)
-	if repoRoot == "" { // fallback when running from repo root
-		staticDir = staticDirRel
-	}
-	staticDir = filepath.Clean(staticDir)
+	cfg := app.config()
+	staticDir := filepath.Clean(cfg.path(cfg.Paths.Static))
 
 	e.Static("/", staticDir)
-	e.Static("/images", dataDir())
+	e.Static("/images", app.dataDir())
 
 	// Dashboard data
 	e.GET("/api/dash/monolithic", func(c echo.Context) error {
-		return c.JSON(http.StatusOK, snapshot())
+		return c.JSON(http.StatusOK, app.snapshot())
 	})
 
 	// Old Session Dashboard data
 	e.GET("/api/dash/session", func(c echo.Context) error {
-		err := loadAllSessions()
+		err := app.loadAllSessions()
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 		}
 		datetime := c.QueryParam("datetime")
-		return c.JSON(http.StatusOK, prevSnapshot(datetime))
+		return c.JSON(http.StatusOK, app.prevSnapshot(datetime))
 	})
 
 	e.GET("/api/sessionlist", func(c echo.Context) error {
-		err := loadAllSessions()
+		err := app.loadAllSessions()
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 		}
-		return c.JSON(http.StatusOK, listSessionStartTimes())
+		return c.JSON(http.StatusOK, app.listSessionStartTimes())
 	})
 
 	// Session controls
 	e.POST("/api/session/start", func(c echo.Context) error {
-		mu.Lock()
-		sessionActive = true
-		sessionStart = time.Now()
-		samplesCount = 0
-		focusHistory = nil
-		currentSessionID = time.Now().Format("20060102-150405")
-		mu.Unlock()
-		startScheduler(e)
-		if err := saveState(); err != nil {
-			klog.Errorf("saveState failed: %v", err)
+		if err := app.beginSession(time.Now(), "", false); err != nil {
+			klog.Errorf("beginSession failed: %v", err)
+		}
+		if !app.startScheduler(e) {
+			// Already running (standby): the session's first sample is due now
+			app.kickScheduler()
 		}
 		return c.JSON(http.StatusOK, map[string]any{"ok": true})
 	})
 
 	e.POST("/api/session/stop", func(c echo.Context) error {
-		mu.Lock()
-		wasActive := sessionActive
-		id := currentSessionID
-		start := sessionStart
-		sc := samplesCount
-		fh := append([]FocusPoint(nil), focusHistory...)
-		la := lastAnalysis
-		sessionActive = false
-		currentSessionID = ""
-		mu.Unlock()
-		stopScheduler()
-		if wasActive {
-			s := Session{
-				ID:           id,
-				Start:        start,
-				End:          time.Now(),
-				SamplesCount: sc,
-				FocusHistory: fh,
-				LastAnalysis: la,
-			}
-			if err := saveCompletedSession(s); err != nil {
-				klog.Errorf("saveCompletedSession failed: %v", err)
-			} else {
-				mu.Lock()
-				sessions = append(sessions, s)
-				mu.Unlock()
-			}
+		if _, err := app.endSession(time.Now(), "", false); err != nil {
+			klog.Errorf("endSession failed: %v", err)
 		}
-		if err := saveState(); err != nil {
-			klog.Errorf("saveState failed: %v", err)
+		if app.standbyEnabled() {
+			app.enterStandby(e, false)
+		} else {
+			app.stopScheduler()
 		}
 		return c.JSON(http.StatusOK, map[string]any{"ok": true})
 	})
 
+	// The analysis prompt in use, as template and as sent to the model
+	e.GET("/api/prompt", func(c echo.Context) error {
+		p := app.activePrompt()
+		return c.JSON(http.StatusOK, map[string]any{"template": p, "text": p.Text()})
+	})
+
+	// Model usage per day and the budget
+	e.GET("/api/usage", func(c echo.Context) error {
+		app.mu.RLock()
+		usage := map[string]any{
+			"session": app.sessionUsage,
+			"daily":   maps.Clone(app.dailyUsage),
+			"budget":  app.budgetStatusLocked(time.Now()),
+		}
+		app.mu.RUnlock()
+		return c.JSON(http.StatusOK, usage)
+	})
+
+	// Effective configuration and where each value came from (read-only)
+	e.GET("/api/config", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, app.config().view())
+	})
+
+	// Re-read the config and apply it to the running station (see reload.go)
+	e.POST("/api/admin/reload", func(c echo.Context) error {
+		if token := app.config().Server.AdminToken; token != "" {
+			got := c.Request().Header.Get("X-Admin-Token")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				return c.JSON(http.StatusUnauthorized, map[string]any{"error": "bad admin token"})
+			}
+		}
+		res, err := app.reload()
+		if err != nil {
+			klog.Errorf("config reload failed: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		klog.Infof("config reloaded: changed %v, restart required for %v", res.Changed, res.Restart)
+		return c.JSON(http.StatusOK, res)
+	})
+
 	// Health
 	e.GET("/api/health", func(c echo.Context) error {
 		return c.String(http.StatusOK, "ok")
 	})
 
-	// Immediate capture + analysis
+	// Live ambient levels and noise spikes from the audio monitor.
+	// ?since=<RFC3339> limits the series; default is the whole window.
+	e.GET("/api/audio/levels", func(c echo.Context) error {
+		mon := app.monitor()
+		if mon == nil {
+			return c.JSON(http.StatusNotFound, map[string]any{"error": "audio monitor disabled (audio.monitor)"})
+		}
+		var since time.Time
+		if v := c.QueryParam("since"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]any{"error": "since: " + err.Error()})
+			}
+			since = t
+		}
+		levels, events := mon.series(since)
+		return c.JSON(http.StatusOK, map[string]any{
+			"resolution_ms": mon.resolution.Milliseconds(),
+			"live":          mon.live(),
+			"levels":        levels,
+			"events":        events,
+		})
+	})
+
+	// External trigger for an out-of-band sample (see triggers.go). Body is
+	// optional: {"detail": "..."}.
+	e.POST("/api/triggers/webhook", func(c echo.Context) error {
+		if token := app.config().Trigger.WebhookToken; token != "" {
+			got := c.Request().Header.Get("X-Trigger-Token")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				return c.JSON(http.StatusUnauthorized, map[string]any{"error": "bad trigger token"})
+			}
+		}
+		var body struct {
+			Detail string `json:"detail"`
+		}
+		if c.Request().ContentLength != 0 {
+			if err := c.Bind(&body); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+			}
+		}
+		if why := app.fireTrigger(triggerWebhook, body.Detail); why != "" {
+			return c.JSON(http.StatusConflict, map[string]any{"accepted": false, "reason": why})
+		}
+		return c.JSON(http.StatusAccepted, map[string]any{"accepted": true})
+	})
+
+	// Immediate capture + analysis. Runs as a background job unless ?wait=true.
 	e.POST("/api/capture/once", func(c echo.Context) error {
-		img, aud, err := runCaptureOnce()
+		if wait, _ := strconv.ParseBool(c.QueryParam("wait")); !wait {
+			job := app.jobs.submit()
+			return c.JSON(http.StatusAccepted, map[string]any{
+				"job_id": job.ID,
+				"status": job.Status,
+				"url":    "/api/capture/jobs/" + job.ID,
+			})
+		}
+		res, err := app.takeSample(c.Request().Context())
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+			status := http.StatusInternalServerError
+			if isAnalysisError(err) {
+				status = http.StatusBadGateway
+			}
+			return c.JSON(status, map[string]any{"error": err.Error()})
+		}
+		if app.recordSample(res) {
+			if err := app.saveState(); err != nil {
+				klog.Errorf("saveState failed: %v", err)
+			}
+		}
+		return c.JSON(http.StatusOK, res.Analysis)
+	})
+
+	e.GET("/api/capture/jobs/:id", func(c echo.Context) error {
+		job, ok := app.jobs.get(c.Param("id"))
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]any{"error": "no such job"})
+		}
+		return c.JSON(http.StatusOK, job)
+	})
+
+	e.DELETE("/api/capture/jobs/:id", func(c echo.Context) error {
+		job, ok, err := app.jobs.cancelJob(c.Param("id"))
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]any{"error": "no such job"})
 		}
-        db, err := readAudio(aud)
-        if err != nil {
-            return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
-        }
-		a, err := analyzeImage(img)
 		if err != nil {
-			return c.JSON(http.StatusBadGateway, map[string]any{"error": err.Error()})
-		}
-		mu.Lock()
-		lastImageFile = img
-		lastAnalysis = a
-		samplesCount++
-		focusHistory = append(focusHistory, FocusPoint{Timestamp: time.Now().Format(time.RFC3339), 
-			FocusLevel: a.FocusLevel, IsAway: a.IsAway, IsFocused: a.IsFocused, Decibels: db})
-		mu.Unlock()
-		if err := saveState(); err != nil {
-			klog.Errorf("saveState failed: %v", err)
-		}
-		return c.JSON(http.StatusOK, a)
+			return c.JSON(http.StatusConflict, map[string]any{"error": err.Error(), "job": job})
+		}
+		return c.JSON(http.StatusOK, job)
 	})
 }
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ----- On-disk schema -----
+//
+// state.gob and session-*.gob (the extension is historical) hold a framed
+// JSON document:
+//
+//	{"schema": 1, "kind": "state" | "session", "data": {...}}
+//
+// data is decoded into PersistedState or sessionDoc, which are the explicit
+// on-disk types; changing them in an incompatible way means bumping
+// currentSchemaVersion and registering a migration below. Files from older
+// builds (raw gob or gob inside a v1 frame) load as schema 0.
+
+const currentSchemaVersion = 2
+
+const (
+	docKindState   = "state"
+	docKindSession = "session"
+)
+
+type snapshotDoc struct {
+	Schema int             `json:"schema"`
+	Kind   string          `json:"kind"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// sessionDoc is the on-disk form of Session. Session's own JSON tags belong
+// to the dashboard API and are not used for storage.
+type sessionDoc struct {
+	ID           string             `json:"id"`
+	Start        time.Time          `json:"start"`
+	End          time.Time          `json:"end"`
+	SamplesCount int                `json:"samples_count"`
+	FocusHistory []FocusPoint       `json:"focus_history"`
+	LastAnalysis Analysis           `json:"last_analysis"`
+	Downtime     []Interval         `json:"downtime,omitempty"`
+	Pauses       []Interval         `json:"pauses,omitempty"`
+	Transitions  []Transition       `json:"transitions,omitempty"`
+	NoiseEvents  []NoiseEvent       `json:"noise_events,omitempty"`
+	Distractions []DistractionEvent `json:"distractions,omitempty"`
+	Usage        AnalysisUsage      `json:"usage,omitzero"`
+	ClosedReason string             `json:"closed_reason,omitempty"`
+}
+
+func sessionToDoc(s Session) sessionDoc {
+	return sessionDoc{ID: s.ID, Start: s.Start, End: s.End, SamplesCount: s.SamplesCount,
+		FocusHistory: s.FocusHistory, LastAnalysis: s.LastAnalysis, Downtime: s.Downtime, Pauses: s.Pauses, Transitions: s.Transitions, NoiseEvents: s.NoiseEvents, Distractions: s.Distractions, Usage: s.Usage, ClosedReason: s.ClosedReason}
+}
+
+func (d sessionDoc) session() Session {
+	return Session{ID: d.ID, Start: d.Start, End: d.End, SamplesCount: d.SamplesCount,
+		FocusHistory: d.FocusHistory, LastAnalysis: d.LastAnalysis, Downtime: d.Downtime, Pauses: d.Pauses, Transitions: d.Transitions, NoiseEvents: d.NoiseEvents, Distractions: d.Distractions, Usage: d.Usage, ClosedReason: d.ClosedReason}
+}
+
+// ----- Migrations -----
+
+// migration upgrades a document's data from schema From to From+1. Apply
+// works on the generic JSON form so old shapes need no Go types.
+type migration struct {
+	From        int
+	Description string
+	Apply       func(kind string, data map[string]any) error
+}
+
+var migrations = []migration{
+	{From: 0, Description: "gob field names to snake_case JSON keys", Apply: migrateGobFieldNames},
+	{From: 1, Description: "mark existing decibel readings as unverified", Apply: migrateAudioStatus},
+}
+
+func migrationFrom(v int) (migration, bool) {
+	for _, m := range migrations {
+		if m.From == v {
+			return m, true
+		}
+	}
+	return migration{}, false
+}
+
+// migrateDoc runs every registered migration from version up to current.
+func migrateDoc(kind string, data map[string]any, version int) error {
+	for v := version; v < currentSchemaVersion; v++ {
+		m, ok := migrationFrom(v)
+		if !ok {
+			return fmt.Errorf("no migration registered from schema %d", v)
+		}
+		if err := m.Apply(kind, data); err != nil {
+			return fmt.Errorf("migration %d->%d (%s): %w", v, v+1, m.Description, err)
+		}
+	}
+	return nil
+}
+
+// migrateGobFieldNames: schema 0 documents are the old gob structs marshalled
+// with their Go field names (SessionActive, FocusHistory, ...).
+func migrateGobFieldNames(_ string, data map[string]any) error {
+	snakeKeys(data)
+	return nil
+}
+
+// migrateAudioStatus: before schema 2 a failed audio capture silently reused
+// the previous audio.txt, so old readings can't be trusted as fresh.
+func migrateAudioStatus(_ string, data map[string]any) error {
+	points, _ := data["focus_history"].([]any)
+	for _, p := range points {
+		fp, ok := p.(map[string]any)
+		if !ok {
+			continue
+		}
+		if _, ok := fp["audio_status"]; !ok {
+			fp["audio_status"] = audioUnverified
+		}
+	}
+	return nil
+}
+
+func snakeKeys(v any) {
+	switch t := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			val := t[k]
+			snakeKeys(val)
+			if nk := snakeCase(k); nk != k {
+				delete(t, k)
+				t[nk] = val
+			}
+		}
+	case []any:
+		for _, val := range t {
+			snakeKeys(val)
+		}
+	}
+}
+
+// snakeCase turns Go field names into JSON keys: CurrentSessionID -> current_session_id.
+func snakeCase(s string) string {
+	r := []rune(s)
+	var b strings.Builder
+	for i, c := range r {
+		if unicode.IsUpper(c) {
+			prevLower := i > 0 && !unicode.IsUpper(r[i-1])
+			nextLower := i > 0 && i+1 < len(r) && unicode.IsLower(r[i+1])
+			if i > 0 && (prevLower || nextLower) {
+				b.WriteByte('_')
+			}
+			c = unicode.ToLower(c)
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// ----- Legacy (schema 0) gob types, frozen as they were written -----
+
+type legacyAnalysisV0 struct {
+	IsFocused   bool
+	FocusLevel  float64
+	IsAway      bool
+	TextSummary string
+}
+
+type legacyFocusPointV0 struct {
+	Timestamp  string
+	Decibels   float64
+	FocusLevel float64
+	IsFocused  bool
+	IsAway     bool
+}
+
+type legacyStateV0 struct {
+	SessionActive    bool
+	SessionStart     time.Time
+	LastImageFile    string
+	LastAnalysis     legacyAnalysisV0
+	SamplesCount     int
+	FocusHistory     []legacyFocusPointV0
+	CurrentSessionID string
+}
+
+type legacySessionV0 struct {
+	ID           string
+	Start        time.Time
+	End          time.Time
+	SamplesCount int
+	FocusHistory []legacyFocusPointV0
+	LastAnalysis legacyAnalysisV0
+}
+
+// ----- Encode / decode -----
+
+func encodeDoc(kind string, v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := json.Marshal(snapshotDoc{Schema: currentSchemaVersion, Kind: kind, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	return frameSnapshot(doc), nil
+}
+
+// decodeDoc unframes b, migrates it to the current schema and unmarshals the
+// data into v. It returns the schema version the file was written with.
+func decodeDoc(b []byte, kind string, v any) (int, error) {
+	payload, frame, err := unframeSnapshot(b)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	var data map[string]any
+	if frame == frameVersionJSON {
+		var doc snapshotDoc
+		if err := json.Unmarshal(payload, &doc); err != nil {
+			return 0, err
+		}
+		if doc.Kind != kind {
+			return doc.Schema, fmt.Errorf("expected %s document, got %q", kind, doc.Kind)
+		}
+		if doc.Schema > currentSchemaVersion {
+			return doc.Schema, fmt.Errorf("schema %d is newer than this build (%d)", doc.Schema, currentSchemaVersion)
+		}
+		version = doc.Schema
+		if err := json.Unmarshal(doc.Data, &data); err != nil {
+			return version, err
+		}
+	} else {
+		if data, err = decodeLegacyGob(payload, kind); err != nil {
+			return 0, err
+		}
+	}
+	if err := migrateDoc(kind, data, version); err != nil {
+		return version, err
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return version, err
+	}
+	return version, json.Unmarshal(raw, v)
+}
+
+func decodeLegacyGob(payload []byte, kind string) (map[string]any, error) {
+	var legacy any
+	switch kind {
+	case docKindState:
+		legacy = &legacyStateV0{}
+	case docKindSession:
+		legacy = &legacySessionV0{}
+	default:
+		return nil, fmt.Errorf("unknown document kind %q", kind)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(legacy); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(legacy)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]any
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func encodeState(st PersistedState) ([]byte, error) { return encodeDoc(docKindState, st) }
+
+func decodeState(b []byte) (PersistedState, int, error) {
+	var st PersistedState
+	v, err := decodeDoc(b, docKindState, &st)
+	return st, v, err
+}
+
+func encodeSession(s Session) ([]byte, error) { return encodeDoc(docKindSession, sessionToDoc(s)) }
+
+func decodeSession(b []byte) (Session, int, error) {
+	var d sessionDoc
+	v, err := decodeDoc(b, docKindSession, &d)
+	return d.session(), v, err
+}
+
+// ----- `migrate` command -----
+
+// runMigrate implements `api migrate [-dry-run] [-dir DIR | -root DIR
+// -config FILE]`: it reports the schema of every state/session file and
+// rewrites outdated ones. Without -dir the sessions directory comes from the
+// configuration, like for the server.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report only, do not rewrite files")
+	dir := fs.String("dir", "", "sessions directory to migrate (default paths.sessions)")
+	root := fs.String("root", "", "repo root ($BASESTATION_ROOT)")
+	configPath := fs.String("config", "", "config file ($BASESTATION_CONFIG)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *dir == "" {
+		var cfgArgs []string
+		if *root != "" {
+			cfgArgs = append(cfgArgs, "-root", *root)
+		}
+		if *configPath != "" {
+			cfgArgs = append(cfgArgs, "-config", *configPath)
+		}
+		cfg, err := loadConfig("", cfgArgs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			return 2
+		}
+		*dir = cfg.path(cfg.Paths.Sessions)
+	}
+	entries, err := os.ReadDir(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	var converted, current, failed int
+	for _, ent := range entries {
+		name := ent.Name()
+		kind := ""
+		switch {
+		case name == stateFileName:
+			kind = docKindState
+		case strings.HasPrefix(name, "session-") && strings.HasSuffix(name, ".gob"):
+			kind = docKindSession
+		default:
+			continue
+		}
+		path := filepath.Join(*dir, name)
+		from, out, err := migrateFile(path, kind)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("%-40s ERROR %v\n", name, err)
+		case from == currentSchemaVersion:
+			current++
+			fmt.Printf("%-40s schema %d, up to date\n", name, from)
+		case *dryRun:
+			converted++
+			fmt.Printf("%-40s schema %d -> %d (dry run)\n", name, from, currentSchemaVersion)
+		default:
+			if err := writeFileAtomic(path, out, true); err != nil {
+				failed++
+				fmt.Printf("%-40s ERROR write: %v\n", name, err)
+				continue
+			}
+			converted++
+			fmt.Printf("%-40s schema %d -> %d, original kept as %s%s\n", name, from, currentSchemaVersion, name, backupSuffix)
+		}
+	}
+	fmt.Printf("%d converted, %d up to date, %d failed\n", converted, current, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// migrateFile decodes path and returns its original schema plus the file
+// re-encoded at the current schema.
+func migrateFile(path, kind string) (int, []byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	if kind == docKindState {
+		st, from, err := decodeState(b)
+		if err != nil {
+			return from, nil, err
+		}
+		out, err := encodeState(st)
+		return from, out, err
+	}
+	s, from, err := decodeSession(b)
+	if err != nil {
+		return from, nil, err
+	}
+	out, err := encodeSession(s)
+	return from, out, err
+}
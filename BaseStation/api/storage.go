@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ----- Crash-safe persistence -----
+//
+// Snapshots (state.gob, session-*.gob) are written to a temp file, fsynced and
+// renamed into place, so a crash leaves either the old or the new file. Each
+// file carries a small header:
+//
+//	magic "LBST" | frame version uint16 | payload length uint32 | crc32 uint32 | payload
+//
+// Frame version 1 wrapped a gob payload; version 2 wraps the JSON document
+// described in schema.go. Files without the header are the raw gob written by
+// the first builds and are still readable. The previous good state snapshot is
+// kept as state.gob.bak.
+//
+// Between snapshots every recorded FocusPoint is also appended to state.wal so
+// samples taken after the last good snapshot can be replayed on load.
+
+const (
+	snapshotMagic      = "LBST"
+	frameVersionLegacy = 0 // no header at all
+	frameVersionGob    = 1
+	frameVersionJSON   = 2
+	snapshotHdrLen     = 4 + 2 + 4 + 4
+	backupSuffix       = ".bak"
+	walFileName        = "state.wal"
+)
+
+var errBadChecksum = errors.New("snapshot checksum mismatch")
+
+// store is a sessions directory: the state snapshot, its WAL and one file per
+// completed session.
+type store struct {
+	dir string
+}
+
+func (s store) walPath() string { return filepath.Join(s.dir, walFileName) }
+
+// saveSession writes a completed session to its own file.
+func (s store) saveSession(sess Session) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	fname := filepath.Join(s.dir, fmt.Sprintf("session-%s.gob", sess.ID))
+	b, err := encodeSession(sess)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fname, b, false)
+}
+
+// loadSessions reads every completed session; unreadable files are skipped.
+func (s store) loadSessions() ([]Session, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var loaded []Session
+	for _, ent := range entries {
+		name := ent.Name()
+		if name == stateFileName || !strings.HasSuffix(name, ".gob") || !strings.HasPrefix(name, "session-") {
+			continue
+		}
+		path := filepath.Join(s.dir, name)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		sess, schema, err := decodeSession(b)
+		if err != nil {
+			continue
+		}
+		loaded = append(loaded, sess)
+		// Upgrade old files in place so this only happens once
+		if schema < currentSchemaVersion {
+			if out, err := encodeSession(sess); err == nil {
+				_ = writeFileAtomic(path, out, true)
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// frameSnapshot wraps payload in the versioned, checksummed header.
+func frameSnapshot(payload []byte) []byte {
+	buf := make([]byte, snapshotHdrLen, snapshotHdrLen+len(payload))
+	copy(buf, snapshotMagic)
+	binary.BigEndian.PutUint16(buf[4:], frameVersionJSON)
+	binary.BigEndian.PutUint32(buf[6:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[10:], crc32.ChecksumIEEE(payload))
+	return append(buf, payload...)
+}
+
+// unframeSnapshot verifies the header and returns the payload together with
+// its frame version. Data without a header is returned as-is with version 0.
+func unframeSnapshot(b []byte) ([]byte, int, error) {
+	if len(b) < snapshotHdrLen || string(b[:4]) != snapshotMagic {
+		return b, frameVersionLegacy, nil
+	}
+	ver := int(binary.BigEndian.Uint16(b[4:]))
+	if ver != frameVersionGob && ver != frameVersionJSON {
+		return nil, ver, fmt.Errorf("unsupported snapshot frame version %d", ver)
+	}
+	n := binary.BigEndian.Uint32(b[6:])
+	payload := b[snapshotHdrLen:]
+	if uint32(len(payload)) != n {
+		return nil, ver, fmt.Errorf("snapshot truncated: have %d of %d bytes", len(payload), n)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(b[10:]) {
+		return nil, ver, errBadChecksum
+	}
+	return payload, ver, nil
+}
+
+// writeFileAtomic replaces path with data via temp file + fsync + rename.
+// The new file keeps the old one's mode (0644 for a new file). With
+// keepBackup the file being replaced is kept as path.bak.
+func writeFileAtomic(path string, data []byte, keepBackup bool) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	mode := os.FileMode(0o644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	cleanup := func() { _ = os.Remove(tmpName) }
+	// CreateTemp makes it 0600
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		cleanup()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		cleanup()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		cleanup()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		cleanup()
+		return err
+	}
+	if keepBackup && fileExists(path) {
+		if err := os.Rename(path, path+backupSuffix); err != nil {
+			cleanup()
+			return err
+		}
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		cleanup()
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// readSnapshotWithFallback runs decode on the contents of path, falling back
+// to path.bak when the primary is missing or corrupt. It returns the file
+// actually used.
+func readSnapshotWithFallback(path string, decode func([]byte) error) (string, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		if err = decode(b); err == nil {
+			return path, nil
+		}
+	}
+	primaryErr := err
+	bak := path + backupSuffix
+	b, err = os.ReadFile(bak)
+	if err != nil {
+		return "", primaryErr
+	}
+	if err := decode(b); err != nil {
+		return "", fmt.Errorf("%v (backup also unreadable: %v)", primaryErr, err)
+	}
+	return bak, nil
+}
+
+// ----- FocusPoint write-ahead log -----
+
+// walRecord is one sample appended to state.wal. Index is the sample's
+// position in focusHistory so replay can skip what the snapshot already has.
+type walRecord struct {
+	SessionID string     `json:"session_id"`
+	Index     int        `json:"index"`
+	ImageFile string     `json:"image_file"`
+	Analysis  Analysis   `json:"analysis"`
+	Point     FocusPoint `json:"point"`
+}
+
+// appendWAL appends rec as a length+crc framed JSON record and fsyncs.
+func (s store) appendWAL(rec walRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.walPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(hdr[4:], crc32.ChecksumIEEE(payload))
+	if _, err := f.Write(append(hdr[:], payload...)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// readWAL returns all intact records; a torn or corrupt tail is ignored.
+func (s store) readWAL() ([]walRecord, error) {
+	f, err := os.Open(s.walPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var recs []walRecord
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			break
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(hdr[0:]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(hdr[4:]) {
+			break
+		}
+		var rec walRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			break
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// resetWAL drops the log; called when a session starts or ends.
+func (s store) resetWAL() error {
+	if err := os.Remove(s.walPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// replayWALLocked applies WAL samples for the current session that are newer
+// than the loaded snapshot. Caller must hold mu.
+func (app *App) replayWALLocked(recs []walRecord) int {
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].Index < recs[j].Index })
+	n := 0
+	for _, rec := range recs {
+		if rec.SessionID == "" || rec.SessionID != app.currentSessionID || rec.Index != len(app.focusHistory) {
+			continue
+		}
+		app.focusHistory = append(app.focusHistory, rec.Point)
+		app.lastImageFile = rec.ImageFile
+		app.lastAnalysis = rec.Analysis
+		app.samplesCount++
+		n++
+	}
+	return n
+}
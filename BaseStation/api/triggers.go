@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ----- Out-of-band capture triggers -----
+//
+// Besides the scheduler tick, a sample can be triggered by
+//   - a noise spike from the audio monitor (trigger.on_spike),
+//   - the level crossing trigger.db_threshold upwards,
+//   - POST /api/triggers/webhook (guarded by trigger.webhook_token if set).
+//
+// Triggers only fire while a session is studying (not paused) and at most
+// once per trigger.cooldown. The capture goes through the coordinator like any
+// other, the sample is tagged with its trigger in the focus history, and the
+// outcome is kept as a DistractionEvent in the session.
+
+const (
+	triggerNoiseSpike = "noise_spike"
+	triggerThreshold  = "threshold"
+	triggerWebhook    = "webhook"
+
+	defaultTriggerCooldown = 30 * time.Second
+	// Upper bound for one triggered capture + analysis.
+	triggerCaptureTimeout = 2 * time.Minute
+)
+
+// DistractionEvent is an out-of-band sample and what it found.
+type DistractionEvent struct {
+	Time       time.Time `json:"time"`
+	Trigger    string    `json:"trigger"`
+	Detail     string    `json:"detail,omitempty"`
+	SampleAt   time.Time `json:"sample_at,omitzero"`
+	FocusLevel float64   `json:"focus_level"`
+	IsFocused  bool      `json:"is_focused"`
+	IsAway     bool      `json:"is_away"`
+	Distracted bool      `json:"distracted"` // at the desk and not focused
+	Error      string    `json:"error,omitempty"`
+}
+
+type triggerState struct {
+	mu    sync.Mutex
+	last  time.Time
+	above bool // last level was over the threshold
+}
+
+// observeLevel is fed every monitor level; spikeStarted is set when the level
+// opened a noise spike.
+func (app *App) observeLevel(p LevelPoint, spikeStarted bool) {
+	cfg := app.config()
+	if spikeStarted && cfg.Trigger.OnSpike {
+		app.fireTrigger(triggerNoiseSpike, fmt.Sprintf("%.1f dB spike", p.AvgDB))
+	}
+	thr := cfg.Trigger.DBThreshold
+	if thr == 0 {
+		return
+	}
+	app.triggers.mu.Lock()
+	crossed := p.AvgDB >= thr && !app.triggers.above
+	app.triggers.above = p.AvgDB >= thr
+	app.triggers.mu.Unlock()
+	if crossed {
+		app.fireTrigger(triggerThreshold, fmt.Sprintf("%.1f dB over %.1f dB threshold", p.AvgDB, thr))
+	}
+}
+
+// fireTrigger starts an out-of-band sample in the background. It returns an
+// empty string if the trigger was accepted, otherwise why it was ignored.
+func (app *App) fireTrigger(source, detail string) string {
+	app.mu.RLock()
+	state := app.sessionStateLocked()
+	sessionID := app.currentSessionID
+	app.mu.RUnlock()
+	if state != stateStudying {
+		return "no session is being studied (" + state + ")"
+	}
+
+	now := time.Now()
+	app.triggers.mu.Lock()
+	if wait := app.triggers.last.Add(app.config().Trigger.Cooldown).Sub(now); wait > 0 {
+		app.triggers.mu.Unlock()
+		return fmt.Sprintf("cooling down for %s", wait.Round(time.Second))
+	}
+	app.triggers.last = now
+	app.triggers.mu.Unlock()
+
+	fmt.Printf("Trigger %s: %s\n", source, detail)
+	go app.runTrigger(sessionID, DistractionEvent{Time: now, Trigger: source, Detail: detail})
+	return ""
+}
+
+// runTrigger takes the sample and records the event against the session that
+// was active when the trigger fired.
+func (app *App) runTrigger(sessionID string, ev DistractionEvent) {
+	ctx, cancel := context.WithTimeout(app.procCtx, triggerCaptureTimeout)
+	defer cancel()
+	res, err := app.takeSample(ctx)
+	app.mu.RLock()
+	same := app.sessionActive && app.currentSessionID == sessionID
+	app.mu.RUnlock()
+	if app.procCtx.Err() != nil || !same {
+		// Shutting down, or the session ended while we were capturing
+		return
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	} else {
+		ev.SampleAt = res.TakenAt
+		ev.FocusLevel = res.Analysis.FocusLevel
+		ev.IsFocused = res.Analysis.IsFocused
+		ev.IsAway = res.Analysis.IsAway
+		ev.Distracted = !res.Analysis.IsAway && !res.Analysis.IsFocused
+		// The scheduler may have joined this capture and recorded it first;
+		// then it stays untagged and only the event refers to it. Presence
+		// is left to the regular ticks so the away streak counts evenly
+		// spaced samples.
+		res.Trigger = ev.Trigger
+		app.recordSample(res)
+	}
+
+	app.mu.Lock()
+	app.distractionEvents = append(app.distractionEvents, ev)
+	app.mu.Unlock()
+	if err := app.saveState(); err != nil {
+		fmt.Printf("saveState failed: %v\n", err)
+	}
+}
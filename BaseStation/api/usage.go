@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ----- Model usage, cost and budget -----
+//
+// Every generateContent call's usageMetadata, estimated cost and latency are
+// attached to the Analysis it produced (summed over retries) and added to
+// per-session and per-day totals, including calls whose reply was rejected.
+//
+// Cost uses gemini.price_input_per_mtok / gemini.price_output_per_mtok (USD
+// per million tokens; thinking tokens bill as output). With budget.daily_usd
+// and/or budget.session_usd set, going over budget either slows sampling down
+// by budget.slow_factor (budget.action = "slow", the default) or stops
+// analysis ("stop").
+
+const (
+	// gemini-2.5-flash list prices
+	defaultPriceInputPerMTok  = 0.30
+	defaultPriceOutputPerMTok = 2.50
+
+	budgetActionSlow        = "slow"
+	budgetActionStop        = "stop"
+	defaultBudgetSlowFactor = 5
+
+	// Days of per-day totals kept in the state snapshot by default
+	// (retention.usage_days)
+	usageDaysKept = 60
+)
+
+var errBudgetExceeded = errors.New("analysis budget exceeded")
+
+// AnalysisUsage is what producing one Analysis cost.
+type AnalysisUsage struct {
+	Calls         int     `json:"calls"`
+	PromptTokens  int     `json:"prompt_tokens"`
+	OutputTokens  int     `json:"output_tokens"`
+	ThoughtTokens int     `json:"thought_tokens,omitempty"`
+	TotalTokens   int     `json:"total_tokens"`
+	CostUSD       float64 `json:"cost_usd"`
+	LatencyMs     int64   `json:"latency_ms"`
+}
+
+func (u *AnalysisUsage) add(o AnalysisUsage) {
+	u.Calls += o.Calls
+	u.PromptTokens += o.PromptTokens
+	u.OutputTokens += o.OutputTokens
+	u.ThoughtTokens += o.ThoughtTokens
+	u.TotalTokens += o.TotalTokens
+	u.CostUSD += o.CostUSD
+	u.LatencyMs += o.LatencyMs
+}
+
+// usageMetadata is the usage block of a GenerateContent response.
+type usageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	ThoughtsTokenCount   int `json:"thoughtsTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+// callUsage prices one call at cfg's prices.
+func callUsage(cfg Config, m usageMetadata, latency time.Duration) AnalysisUsage {
+	in, out := cfg.Gemini.PriceInputPerMTok, cfg.Gemini.PriceOutputPerMTok
+	return AnalysisUsage{
+		Calls:         1,
+		PromptTokens:  m.PromptTokenCount,
+		OutputTokens:  m.CandidatesTokenCount,
+		ThoughtTokens: m.ThoughtsTokenCount,
+		TotalTokens:   m.TotalTokenCount,
+		CostUSD:       (float64(m.PromptTokenCount)*in + float64(m.CandidatesTokenCount+m.ThoughtsTokenCount)*out) / 1e6,
+		LatencyMs:     latency.Milliseconds(),
+	}
+}
+
+// recordUsage adds a call to the session and day totals.
+func (app *App) recordUsage(u AnalysisUsage, at time.Time) {
+	day := at.Format(time.DateOnly)
+	app.mu.Lock()
+	if app.sessionActive {
+		app.sessionUsage.add(u)
+	}
+	if app.dailyUsage == nil {
+		app.dailyUsage = map[string]AnalysisUsage{}
+	}
+	d := app.dailyUsage[day]
+	d.add(u)
+	app.dailyUsage[day] = d
+	app.pruneDailyUsageLocked()
+	app.mu.Unlock()
+}
+
+// pruneDailyUsageLocked drops the oldest days beyond retention.usage_days.
+// Caller must hold mu.
+func (app *App) pruneDailyUsageLocked() {
+	keep := app.config().Retention.UsageDays
+	if len(app.dailyUsage) <= keep {
+		return
+	}
+	days := make([]string, 0, len(app.dailyUsage))
+	for d := range app.dailyUsage {
+		days = append(days, d)
+	}
+	sort.Strings(days)
+	for _, d := range days[:len(days)-keep] {
+		delete(app.dailyUsage, d)
+	}
+}
+
+// BudgetStatus is the budget as shown on the dashboard.
+type BudgetStatus struct {
+	DailyUSD   float64 `json:"daily_usd,omitempty"`
+	SessionUSD float64 `json:"session_usd,omitempty"`
+	Action     string  `json:"action"`
+	Exceeded   bool    `json:"exceeded"`
+	Reason     string  `json:"reason,omitempty"`
+}
+
+// budgetStatusLocked checks spending against the budget. Caller must hold mu.
+func (app *App) budgetStatusLocked(now time.Time) BudgetStatus {
+	cfg := app.config()
+	b := BudgetStatus{
+		DailyUSD:   cfg.Budget.DailyUSD,
+		SessionUSD: cfg.Budget.SessionUSD,
+		Action:     cfg.Budget.Action,
+	}
+	if spent := app.dailyUsage[now.Format(time.DateOnly)].CostUSD; b.DailyUSD > 0 && spent >= b.DailyUSD {
+		b.Exceeded = true
+		b.Reason = fmt.Sprintf("spent $%.4f of $%g today", spent, b.DailyUSD)
+	} else if spent := app.sessionUsage.CostUSD; app.sessionActive && b.SessionUSD > 0 && spent >= b.SessionUSD {
+		b.Exceeded = true
+		b.Reason = fmt.Sprintf("spent $%.4f of $%g this session", spent, b.SessionUSD)
+	}
+	return b
+}
+
+func (app *App) budgetStatus(now time.Time) BudgetStatus {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	return app.budgetStatusLocked(now)
+}
+
+// checkBudget returns errBudgetExceeded if analysis is stopped by the budget.
+func (app *App) checkBudget(now time.Time) error {
+	if b := app.budgetStatus(now); b.Exceeded && b.Action == budgetActionStop {
+		return fmt.Errorf("%w: %s", errBudgetExceeded, b.Reason)
+	}
+	return nil
+}
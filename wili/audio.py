@@ -7,6 +7,7 @@ import math
 import pathlib
 import time
 import argparse
+import json
 import result
 
 # Ensure we use the local freewili module
@@ -26,7 +27,14 @@ def event_handler(event_type: EventType, frame: ResponseFrame, data: AudioData)
     # print('data', data.data)
     cur_audio_data.append(data.data)
 
-def get_average_decibels(fw: FreeWili) -> float:
+# dB calibration offset for the Wileye microphone (full scale -> SPL-ish)
+DB_OFFSET = 106.0
+FRAME_SECONDS = 0.05
+# Spectral bands in Hz: rumble/hum, voice, hiss/cymbals/treble
+BANDS = {"low": (20, 300), "speech": (300, 3400), "high": (3400, 8000)}
+BAND_PROBES = 12  # Goertzel probe frequencies per band
+
+def collect_samples(fw: FreeWili) -> list:
     global audio_bytes
 
     fw.set_event_callback(event_handler)
@@ -49,23 +57,130 @@ def get_average_decibels(fw: FreeWili) -> float:
         except KeyboardInterrupt:
             print("\nStopping audio recording...")
             break
-    
-    if not audio_bytes:
+
+    return list(struct.unpack("<" + "h" * (len(audio_bytes) // 2), audio_bytes))
+
+def to_db(amplitude: float) -> float:
+    # floor at one LSB so silence stays finite (JSON has no -inf)
+    return 20 * math.log10(max(amplitude, 1.0) / 32768) + DB_OFFSET
+
+def percentile(sorted_vals: list, p: float) -> float:
+    if not sorted_vals:
         return 0.0
-    
-    samples = list(struct.unpack("<" + "h" * (len(audio_bytes) // 2), audio_bytes))
+    k = (len(sorted_vals) - 1) * p
+    lo, hi = math.floor(k), math.ceil(k)
+    return sorted_vals[lo] + (sorted_vals[hi] - sorted_vals[lo]) * (k - lo)
+
+def goertzel_power(frame: list, freq: float, rate: float) -> float:
+    coeff = 2 * math.cos(2 * math.pi * freq / rate)
+    s_prev = s_prev2 = 0.0
+    for x in frame:
+        s = x + coeff * s_prev - s_prev2
+        s_prev2, s_prev = s_prev, s
+    return s_prev2 ** 2 + s_prev ** 2 - coeff * s_prev * s_prev2
+
+def band_energies(frames: list, rate: float) -> dict:
+    """Relative energy per band, probed with Goertzel on up to 20 loud frames."""
+    nyquist = rate / 2
+    loud = sorted(frames, key=lambda f: sum(x * x for x in f), reverse=True)[:20]
+    totals = {}
+    for name, (lo, hi) in BANDS.items():
+        hi = min(hi, nyquist * 0.95)
+        if hi <= lo or not loud:
+            totals[name] = 0.0
+            continue
+        step = (hi - lo) / BAND_PROBES
+        probes = [lo + step * (i + 0.5) for i in range(BAND_PROBES)]
+        totals[name] = sum(goertzel_power(f, fr, rate) for f in loud for fr in probes) * (hi - lo)
+    total = sum(totals.values())
+    return {k: (v / total if total > 0 else 0.0) for k, v in totals.items()}
+
+def summarize(samples: list, rate: float) -> dict:
+    """Level statistics plus a few cheap features that separate speech, music and ambient noise."""
+    n = len(samples)
+    rms = math.sqrt(sum(x * x for x in samples) / n)
+    peak = max(abs(x) for x in samples)
+
+    frame_len = max(32, int(rate * FRAME_SECONDS))
+    frames = [samples[i:i + frame_len] for i in range(0, n - frame_len + 1, frame_len)] or [samples]
+    frame_rms = [math.sqrt(sum(x * x for x in f) / len(f)) for f in frames]
+    frame_db = sorted(to_db(r) for r in frame_rms)
 
-    # find rms
-    rms = math.sqrt(sum(sample**2 for sample in samples) / len(samples))
-    if rms == 0:
-        return -float('inf') # silence
-    
-    decibels = 20 * math.log10(rms / 32768) + 106.0
-    return decibels
+    # Speech switches on and off at syllable rate, so its frame envelope
+    # varies a lot; music and ambient noise are steadier.
+    mean_env = sum(frame_rms) / len(frame_rms)
+    env_var = 0.0
+    if mean_env > 0:
+        env_var = math.sqrt(sum((r - mean_env) ** 2 for r in frame_rms) / len(frame_rms)) / mean_env
+    zcr = sum(1 for a, b in zip(samples, samples[1:]) if (a < 0) != (b < 0)) / max(n - 1, 1)
+    bands = band_energies(frames, rate)
+
+    speech = bands.get("speech", 0.0) * min(env_var / 0.8, 1.0)
+    if not 0.02 <= zcr <= 0.25:
+        speech *= 0.5
+
+    return {
+        "version": 1,
+        "duration_s": round(n / rate, 3),
+        "sample_rate": round(rate, 1),
+        "samples": n,
+        "avg_db": to_db(rms),
+        "peak_db": to_db(peak),
+        "rms": rms / 32768,
+        "percentiles_db": {
+            "p10": percentile(frame_db, 0.10),
+            "p50": percentile(frame_db, 0.50),
+            "p90": percentile(frame_db, 0.90),
+        },
+        "zero_crossing_rate": zcr,
+        "envelope_variation": env_var,
+        "speech_likelihood": round(min(max(speech, 0.0), 1.0), 3),
+        "bands": bands,
+    }
+
+def stream_levels(fw: FreeWili, resolution: float, sample_rate: float) -> None:
+    """Print one LEVEL line (JSON) per resolution window until killed."""
+    global audio_bytes
+
+    fw.set_event_callback(event_handler)
+    fw.enable_audio_events(True).expect("Failed to enable audio events")
+    print("Streaming audio levels...", flush=True)
+    window_start = time.time()
+
+    while True:
+        try:
+            fw.process_events()
+            if cur_audio_data:
+                for data in cur_audio_data:
+                    audio_bytes += b"".join(struct.pack("<h", sample) for sample in data)
+                cur_audio_data.clear()
+            now = time.time()
+            if now - window_start < resolution:
+                continue
+            samples = list(struct.unpack("<" + "h" * (len(audio_bytes) // 2), audio_bytes))
+            audio_bytes = b""
+            elapsed = now - window_start
+            window_start = now
+            if not samples:
+                continue
+            summary = summarize(samples, sample_rate or len(samples) / elapsed)
+            level = {
+                "t": now,
+                "avg_db": summary["avg_db"],
+                "peak_db": summary["peak_db"],
+                "speech_likelihood": summary["speech_likelihood"],
+            }
+            print("LEVEL " + json.dumps(level), flush=True)
+        except KeyboardInterrupt:
+            print("\nStopping audio stream...")
+            break
 
 def main():
-    parser = argparse.ArgumentParser(description="Capture and average decibels from FreeWili Wileye microphone")
-    parser.add_argument("--dest", dest="dest", default=DEST_OUTPUT_PATH, help="Destination path on host for the average decibel data")
+    parser = argparse.ArgumentParser(description="Capture and summarize audio from FreeWili Wileye microphone")
+    parser.add_argument("--dest", dest="dest", default=DEST_OUTPUT_PATH, help="Destination path on host; .json gets the full summary, anything else just the average decibels")
+    parser.add_argument("--sample-rate", dest="sample_rate", type=float, default=0, help="Microphone sample rate in Hz (default: estimated from the capture window)")
+    parser.add_argument("--stream", action="store_true", help="Run continuously, printing a LEVEL line per --resolution window instead of writing --dest")
+    parser.add_argument("--resolution", type=float, default=1.0, help="Seconds per LEVEL line in --stream mode")
     args = parser.parse_args()
 
     try:
@@ -78,14 +193,27 @@ def main():
         print("2. Powered on")
         print("3. Recognized by your system")
         return
-    
-    avg = get_average_decibels(fw)
+
+    if args.stream:
+        stream_levels(fw, args.resolution, args.sample_rate)
+        return
+
+    samples = collect_samples(fw)
+    if not samples:
+        print("Error: no audio samples received")
+        return
+    rate = args.sample_rate or len(samples) / DURATION
+    summary = summarize(samples, rate)
 
     # ensure destination directory exists
     dest = pathlib.Path(args.dest)
     dest.parent.mkdir(parents=True, exist_ok=True)
     with open(str(dest), 'w') as f:
-        f.write(str(avg))
+        if dest.suffix == ".json":
+            json.dump(summary, f)
+        else:
+            f.write(str(summary["avg_db"]))
+    print(f"Audio saved to: {dest.absolute()}")
 
 if __name__ == '__main__':
     main()
@@ -191,10 +191,14 @@ export default function App() {
     { name: "Unfocused", value: unfocusedPercent },
   ];
 
-  const lineData = useMemo(() => focusHistoryData.map(entry => ({
-    timestamp: entry.timestamp,
-    value: entry.decibels ?? 0,
-  })), [focusHistoryData]);
+  // Samples whose audio capture failed have decibels: null; leave them out
+  // rather than plotting them as silence.
+  const lineData = useMemo(() => focusHistoryData
+    .filter(entry => typeof entry.decibels === "number")
+    .map(entry => ({
+      timestamp: entry.timestamp,
+      value: entry.decibels,
+    })), [focusHistoryData]);
 
   // Contextual insights for charts
   const decibelInsight = useMemo(() => {
@@ -518,6 +522,7 @@ export default function App() {
               <ChartContainer
                 config={{
                   focus_level: { label: "Focus Level", color: "#34d399" },
+                  smoothed_focus_level: { label: "Trend", color: "#60a5fa" },
                 }}
                 className="h-full w-full"
               >
@@ -551,6 +556,15 @@ export default function App() {
                     dot={{ r: 2.5 }}
                     activeDot={{ r: 4 }}
                   />
+                  <Line
+                    type="monotone"
+                    dataKey="smoothed_focus_level"
+                    stroke="var(--color-smoothed_focus_level)"
+                    strokeWidth={2}
+                    strokeDasharray="4 3"
+                    dot={false}
+                    connectNulls
+                  />
                 </LineChart>
               </ChartContainer>
             )}